@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//admission filter of hotCache. a value fetched from a peer is only kept as a
+//replica in hotCache if Admit returns true, so that one-off lookups of keys
+//owned by other peers do not evict genuinely hot replicas
+type Admission interface {
+	Admit(key string) bool
+}
+
+//A function type, so that Admission can be a function
+type AdmissionFunc func(key string) bool
+
+func (a AdmissionFunc) Admit(key string) bool {
+	return a(key)
+}
+
+//admit every value, the default
+var AdmitAll Admission = AdmissionFunc(func(string) bool { return true })
+
+//admit a value with probability 1/n, like groupcache's 1-in-10. n <= 1 admits
+//every value
+func SampledAdmission(n int) Admission {
+	return AdmissionFunc(func(string) bool {
+		return n <= 1 || rand.Intn(n) == 0
+	})
+}
+
+//admit a value only after its key is requested at least k times within
+//window. concurrency safe
+func FrequencyAdmission(k int, window time.Duration) Admission {
+	return &frequencyAdmission{k: k, window: window}
+}
+
+//counts requests in two generations, so that a request is remembered for at
+//least one and at most two windows, and memory is bounded by the number of
+//distinct keys seen in two windows
+type frequencyAdmission struct {
+	k      int
+	window time.Duration
+
+	mu        sync.Mutex
+	cur, prev map[string]int
+	rotateAt  time.Time
+}
+
+func (f *frequencyAdmission) Admit(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.cur == nil || now.After(f.rotateAt) {
+		//drop the previous generation as well if idle for more than a window
+		if f.cur != nil && now.Before(f.rotateAt.Add(f.window)) {
+			f.prev = f.cur
+		} else {
+			f.prev = nil
+		}
+		f.cur = make(map[string]int)
+		f.rotateAt = now.Add(f.window)
+	}
+	f.cur[key]++
+	if f.cur[key]+f.prev[key] < f.k {
+		return false
+	}
+	delete(f.cur, key)
+	delete(f.prev, key)
+	return true
+}
@@ -0,0 +1,422 @@
+//Package arena is a cache keeping keys and values in one large byte slab
+//instead of one heap object per entry, like bigcache and freecache. the index
+//maps key hashes to offsets and holds no pointers, so the garbage collector
+//never scans entries no matter how many there are.
+package arena
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+//layout of an entry in slab:
+//	expireAt int64 | ttl int64 | deadline int64 | keyLen uint32 | valLen uint32 |
+//	flags uint8 | key | val
+const headerSize = 8 + 8 + 8 + 4 + 4 + 1
+
+const (
+	offExpireAt = 0
+	offTTL      = 8
+	offDeadline = 16
+	offKeyLen   = 24
+	offValLen   = 28
+	offFlags    = 32
+)
+
+//entry is deleted, overwritten or evicted, its bytes are reclaimed on compact
+const flagDead = 1
+
+//estimated bytes taken by an entry in index besides slab
+const IndexEntryBytes = 32
+
+//entries scanned by RemoveExpired for every entry it may remove
+const scanFactor = 8
+
+//a FIFO cache with TTL backed by a byte slab. entries are appended to the
+//tail of slab and evicted from its head, like bigcache. deleted and
+//overwritten entries leave holes, which are reclaimed by compaction when slab
+//runs out of room. not concurrency safe
+type Cache struct {
+	//callback when entry is deleted, expired, evicted or cleared. val is only
+	//valid during the call
+	OnDroped func(key string, val []byte)
+
+	//callback when entry is evicted by RemoveOldest, after OnDroped. val is
+	//only valid during the call
+	OnEvicted func(key string, val []byte, expireAt time.Time)
+
+	//sliding expiration, see lru.Config
+	Sliding     bool
+	MaxLifetime time.Duration
+
+	slab       []byte
+	first      int            //size of slab preallocated, an empty cache shrinks back to it
+	limit      int            //bytes slab and index may take, 0 means no limit
+	head, tail int            //live region of slab
+	index      map[uint64]int //hash of key -> offset of entry
+	scan       int            //position of RemoveExpired
+	live       int            //number of live entries
+}
+
+//create a cache with a slab of capacity bytes preallocated. slab grows if
+//needed, so capacity only avoids copying
+func New(capacity int) *Cache {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &Cache{
+		slab:  make([]byte, capacity),
+		first: capacity,
+		index: make(map[uint64]int),
+	}
+}
+
+//set bytes slab and index may take together. slab never grows beyond what
+//index leaves of limit, the entries added first are evicted as by
+//RemoveOldest to make room instead. entries added to room left in slab may
+//still take index over limit, the caller evicts by RemoveOldest then. a
+//larger slab is compacted into a smaller one at once. limit <= 0 means no limit
+func (c *Cache) SetLimit(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	c.limit = limit
+	if limit > 0 && c.Bytes() > int64(limit) {
+		c.makeRoom(0)
+	}
+}
+
+//64-bit fnv-1a hash of key
+func hash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+//lazy initialization
+func (c *Cache) lazyInit() {
+	if c.index == nil {
+		c.index = make(map[uint64]int)
+	}
+}
+
+//add entry. if key exists, a copy of its old value is returned with
+//replaced = true. OnDroped is not called for the old value
+func (c *Cache) Add(key string, val []byte, ttl time.Duration) (old []byte, replaced bool) {
+	c.lazyInit()
+	now := time.Now()
+	h := hash(key)
+	if off, ok := c.index[h]; ok {
+		if c.key(off) == key {
+			old = append([]byte(nil), c.val(off)...)
+			replaced = true
+			c.kill(off)
+		} else {
+			//hash collision, the older entry goes
+			c.drop(off)
+		}
+	}
+
+	need := headerSize + len(key) + len(val)
+	if c.tail+need > len(c.slab) {
+		c.makeRoom(need)
+	}
+	off := c.tail
+	e := c.slab[off : off+need]
+	expireAt, deadline := now.Add(ttl), time.Time{}
+	if c.Sliding && c.MaxLifetime > 0 {
+		deadline = now.Add(c.MaxLifetime)
+		if expireAt.After(deadline) {
+			expireAt = deadline
+		}
+	}
+	binary.LittleEndian.PutUint64(e[offExpireAt:], uint64(expireAt.UnixNano()))
+	binary.LittleEndian.PutUint64(e[offTTL:], uint64(ttl))
+	binary.LittleEndian.PutUint64(e[offDeadline:], uint64(unixNano(deadline)))
+	binary.LittleEndian.PutUint32(e[offKeyLen:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(e[offValLen:], uint32(len(val)))
+	e[offFlags] = 0
+	copy(e[headerSize:], key)
+	copy(e[headerSize+len(key):], val)
+	c.tail += need
+	c.index[h] = off
+	c.live++
+	return old, replaced
+}
+
+//look up entry, return a copy of its value. expired entry is deleted and
+//treated as a miss. in sliding mode, a hit pushes expiration forward
+func (c *Cache) Get(key string) ([]byte, bool) {
+	val, _, ok := c.GetWithExpiration(key)
+	return val, ok
+}
+
+//same as Get, but return expiration of entry as well
+func (c *Cache) GetWithExpiration(key string) (val []byte, expireAt time.Time, ok bool) {
+	off, hit := c.lookup(key)
+	if !hit {
+		return nil, expireAt, false
+	}
+	now := time.Now()
+	if c.expireAt(off).Before(now) {
+		c.drop(off)
+		return nil, expireAt, false
+	}
+	if c.Sliding {
+		c.touch(off, now)
+	}
+	return append([]byte(nil), c.val(off)...), c.expireAt(off), true
+}
+
+//look up entry without updating expiration
+func (c *Cache) Peek(key string) (val []byte, expireAt time.Time, ok bool) {
+	off, hit := c.lookup(key)
+	if !hit || c.expireAt(off).Before(time.Now()) {
+		return nil, expireAt, false
+	}
+	return append([]byte(nil), c.val(off)...), c.expireAt(off), true
+}
+
+//call f on every entry not expired in insertion order, until f returns false.
+//val is a copy. expiration is not updated
+func (c *Cache) Range(f func(key string, val []byte, expireAt time.Time) bool) {
+	now := time.Now()
+	for off := c.head; off < c.tail; off += c.size(off) {
+		if c.dead(off) || c.expireAt(off).Before(now) {
+			continue
+		}
+		if !f(c.key(off), append([]byte(nil), c.val(off)...), c.expireAt(off)) {
+			return
+		}
+	}
+}
+
+//delete entry, return false if not exist
+func (c *Cache) Del(key string) bool {
+	off, hit := c.lookup(key)
+	if hit {
+		c.drop(off)
+	}
+	return hit
+}
+
+//evict the entry added first, OnDroped is called as for Del. val is a copy.
+//return false if cache is empty
+func (c *Cache) RemoveOldest() (key string, val []byte, ok bool) {
+	off, ok := c.evictOldest()
+	if !ok {
+		return "", nil, false
+	}
+	return c.key(off), append([]byte(nil), c.val(off)...), true
+}
+
+//remove at most limit entries expired at the moment now. entries are not kept
+//in expiration order, so every call scans at most scanFactor*limit entries
+//from where the last call stopped. return number of entries removed
+func (c *Cache) RemoveExpired(now time.Time, limit int) int {
+	if c.scan < c.head || c.scan > c.tail {
+		c.scan = c.head
+	}
+	count := 0
+	for scanned := 0; count < limit && scanned < scanFactor*limit; scanned++ {
+		if c.scan >= c.tail {
+			c.scan = c.head
+			break
+		}
+		off := c.scan
+		c.scan += c.size(off)
+		if !c.dead(off) && c.expireAt(off).Before(now) {
+			c.drop(off)
+			count++
+		}
+	}
+	return count
+}
+
+//return number of live entries
+func (c *Cache) Len() int {
+	return c.live
+}
+
+//return memory used: the whole slab, room not yet occupied included, plus index
+func (c *Cache) Bytes() int64 {
+	return int64(len(c.slab)) + int64(c.indexBytes())
+}
+
+//drop all entries, OnDroped is called for each. slab shrinks back to the size
+//preallocated
+func (c *Cache) Clear() {
+	if c.OnDroped != nil {
+		for off := c.head; off < c.tail; off += c.size(off) {
+			if !c.dead(off) {
+				c.OnDroped(c.key(off), c.val(off))
+			}
+		}
+	}
+	c.index = make(map[uint64]int)
+	c.live = 0
+	c.reset()
+}
+
+//offset of live entry of key
+func (c *Cache) lookup(key string) (int, bool) {
+	off, ok := c.index[hash(key)]
+	if !ok || c.key(off) != key {
+		return 0, false
+	}
+	return off, true
+}
+
+//mark entry at off as dead and unlink it from index, then call OnDroped
+func (c *Cache) drop(off int) {
+	c.kill(off)
+	if c.OnDroped != nil {
+		c.OnDroped(c.key(off), c.val(off))
+	}
+}
+
+//evict the live entry added first, OnDroped and OnEvicted are called. return
+//its offset, the entry stays readable until slab is compacted
+func (c *Cache) evictOldest() (int, bool) {
+	for c.head < c.tail {
+		off := c.head
+		c.head += c.size(off)
+		if c.dead(off) {
+			continue
+		}
+		c.drop(off)
+		if c.OnEvicted != nil {
+			c.OnEvicted(c.key(off), c.val(off), c.expireAt(off))
+		}
+		return off, true
+	}
+	c.reset()
+	return 0, false
+}
+
+//estimated bytes taken by index
+func (c *Cache) indexBytes() int {
+	return len(c.index) * IndexEntryBytes
+}
+
+//mark entry at off as dead and unlink it from index
+func (c *Cache) kill(off int) {
+	c.slab[off+offFlags] |= flagDead
+	h := hash(c.key(off))
+	if c.index[h] == off {
+		delete(c.index, h)
+	}
+	c.live--
+}
+
+//make room for need bytes at tail: live entries are moved to the front of
+//slab and holes are reclaimed. slab is doubled if it would stay more than
+//3/4 full, so that compaction is amortized, but never grows beyond limit
+func (c *Cache) makeRoom(need int) {
+	used := 0
+	for off := c.head; off < c.tail; off += c.size(off) {
+		if !c.dead(off) {
+			used += c.size(off)
+		}
+	}
+	for c.limit > 0 && used > 0 && used+need+c.indexBytes() > c.limit {
+		off, ok := c.evictOldest()
+		if !ok {
+			break
+		}
+		used -= c.size(off)
+	}
+	size := len(c.slab)
+	if (used+need)*4 > size*3 {
+		size = 2 * size
+		for size < (used+need)*4/3+1 {
+			size = 2*size + 1
+		}
+	}
+	if c.limit > 0 && size > c.limit-c.indexBytes() {
+		size = c.limit - c.indexBytes()
+	}
+	if size < used+need {
+		//need alone exceeds limit, or index takes it all
+		size = used + need
+	}
+	slab := c.slab
+	if size != len(c.slab) {
+		slab = make([]byte, size)
+	}
+
+	//moving forward within the same slab never overwrites unread entries
+	pos := 0
+	for off := c.head; off < c.tail; {
+		n := c.size(off)
+		if !c.dead(off) {
+			c.index[hash(c.key(off))] = pos
+			copy(slab[pos:], c.slab[off:off+n])
+			pos += n
+		}
+		off += n
+	}
+	c.slab = slab
+	c.head, c.tail, c.scan = 0, pos, 0
+}
+
+//reset an empty slab, a slab grown beyond the size preallocated is given back
+func (c *Cache) reset() {
+	if c.live == 0 {
+		c.head, c.tail, c.scan = 0, 0, 0
+		if len(c.slab) > c.first {
+			c.slab = make([]byte, c.first)
+		}
+	}
+}
+
+//push expiration of entry at off forward as if it is just accessed
+func (c *Cache) touch(off int, now time.Time) {
+	e := c.slab[off:]
+	expireAt := now.Add(time.Duration(binary.LittleEndian.Uint64(e[offTTL:])))
+	if deadline := int64(binary.LittleEndian.Uint64(e[offDeadline:])); deadline != 0 &&
+		expireAt.UnixNano() > deadline {
+		expireAt = time.Unix(0, deadline)
+	}
+	binary.LittleEndian.PutUint64(e[offExpireAt:], uint64(expireAt.UnixNano()))
+}
+
+func (c *Cache) expireAt(off int) time.Time {
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(c.slab[off+offExpireAt:])))
+}
+
+func (c *Cache) dead(off int) bool {
+	return c.slab[off+offFlags]&flagDead != 0
+}
+
+//total bytes of entry at off
+func (c *Cache) size(off int) int {
+	e := c.slab[off:]
+	return headerSize + int(binary.LittleEndian.Uint32(e[offKeyLen:])) +
+		int(binary.LittleEndian.Uint32(e[offValLen:]))
+}
+
+//key of entry at off, copied into a string
+func (c *Cache) key(off int) string {
+	n := int(binary.LittleEndian.Uint32(c.slab[off+offKeyLen:]))
+	return string(c.slab[off+headerSize : off+headerSize+n])
+}
+
+//value of entry at off, refers to slab
+func (c *Cache) val(off int) []byte {
+	e := c.slab[off:]
+	k := int(binary.LittleEndian.Uint32(e[offKeyLen:]))
+	n := int(binary.LittleEndian.Uint32(e[offValLen:]))
+	return e[headerSize+k : headerSize+k+n]
+}
+
+//UnixNano of t, 0 for zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
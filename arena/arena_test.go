@@ -0,0 +1,106 @@
+package arena
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestArena(t *testing.T) {
+	c := New(0)
+	for i := 0; i < 1000; i++ {
+		c.Add(strconv.Itoa(i), []byte("v"+strconv.Itoa(i)), time.Minute)
+	}
+	//overwrite and delete leave holes that are reclaimed on compaction
+	for i := 0; i < 1000; i += 2 {
+		if old, replaced := c.Add(strconv.Itoa(i), []byte("new"), time.Minute); !replaced ||
+			string(old) != "v"+strconv.Itoa(i) {
+			t.Fatalf("got old value %q, %v", old, replaced)
+		}
+	}
+	for i := 1; i < 1000; i += 4 {
+		c.Del(strconv.Itoa(i))
+	}
+	c.makeRoom(0)
+	for i := 0; i < 1000; i++ {
+		val, ok := c.Get(strconv.Itoa(i))
+		switch {
+		case i%4 == 1:
+			if ok {
+				t.Errorf("get deleted key %d", i)
+			}
+		case i%2 == 0:
+			if string(val) != "new" {
+				t.Errorf("get %d: %q", i, val)
+			}
+		default:
+			if string(val) != "v"+strconv.Itoa(i) {
+				t.Errorf("get %d: %q", i, val)
+			}
+		}
+	}
+	if c.Len() != 750 {
+		t.Errorf("got len %d", c.Len())
+	}
+
+	//evicted in insertion order
+	var dropped []string
+	c.OnDroped = func(key string, val []byte) { dropped = append(dropped, key) }
+	if key, _, ok := c.RemoveOldest(); !ok || key != "3" {
+		t.Errorf("got oldest %q", key)
+	}
+
+	c.Add("short", []byte("v"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if _, _, ok := c.Peek("short"); ok {
+		t.Errorf("peek expired key")
+	}
+	removed := 0
+	for i := 0; i < 100 && removed == 0; i++ {
+		removed = c.RemoveExpired(time.Now(), 10)
+	}
+	if removed != 1 || dropped[len(dropped)-1] != "short" {
+		t.Errorf("removed %d, dropped %v", removed, dropped)
+	}
+
+	c.Clear()
+	if c.Len() != 0 || c.Bytes() != 0 {
+		t.Errorf("got len %d, bytes %d after clear", c.Len(), c.Bytes())
+	}
+}
+
+func TestArenaLimit(t *testing.T) {
+	c := New(100)
+	c.SetLimit(4000)
+	var evicted []string
+	c.OnEvicted = func(key string, val []byte, expireAt time.Time) { evicted = append(evicted, key) }
+	for i := 0; i < 1000; i++ {
+		c.Add(strconv.Itoa(i), []byte("value"), time.Minute)
+		if len(c.slab) > 4000 {
+			t.Fatalf("slab grown to %d bytes after %d adds", len(c.slab), i+1)
+		}
+		for c.Bytes() > 4000 {
+			c.RemoveOldest()
+		}
+	}
+	if len(evicted) == 0 || evicted[0] != "0" {
+		t.Errorf("evicted %v", evicted)
+	}
+	if _, ok := c.Get("999"); !ok {
+		t.Errorf("newest entry evicted")
+	}
+
+	//a lower limit shrinks slab at once, an empty cache gives back what slab
+	//grew beyond its preallocation
+	c.SetLimit(1000)
+	if c.Bytes() > 1000 {
+		t.Errorf("got %d bytes after limit lowered", c.Bytes())
+	}
+	for c.Len() > 0 {
+		c.RemoveOldest()
+	}
+	c.RemoveOldest()
+	if c.Bytes() != 100 {
+		t.Errorf("got %d bytes when empty", c.Bytes())
+	}
+}
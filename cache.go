@@ -2,6 +2,7 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hollowdjj/course-selecting-sys/cache/lru"
@@ -9,102 +10,265 @@ import (
 
 var (
 	delTTL   = 100 //unit: ms
-	delCount = 20
+	delCount = 128 //max number of expired cache removed per lock hold
 )
 
-//encapsulation of LRU cache, concurrency safe
+//estimated memory taken by an entry besides its key and value: list element,
+//lru.Entry, map bucket slot and expiry heap slot
+const DefaultEntryOverhead = 160
+
+//default number of shards of a cache
+const DefaultShards = 16
+
+//encapsulation of LRU cache, concurrency safe. keys are spread over
+//independently locked LRU shards by hash, so goroutines working on different
+//keys seldom wait for each other
 type cache struct {
-	rw           sync.RWMutex
-	lru          *lru.LRUCache //LRU cache
-	nbytes       int64         //memory usage of cache
-	ngets, nhits int64
+	shards   []*shard
+	mask     uint32 //len(shards)-1, len(shards) is a power of 2
+	maxBytes int64  //byte budget of all shards, accessed atomically
+	used     int64  //bytes of all shards, accessed atomically
+
+	//background goroutine started by timingDel, stopped by Close
+	mu     sync.Mutex
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	closed bool
 }
 
-//create a new concurrency safe cache
+//create a new concurrency safe cache with DefaultShards shards
 func NewCache() *cache {
-	res := &cache{lru: lru.New()}
+	res := newCache(DefaultShards)
 	res.timingDel()
 	return res
 }
 
-//add cache, concurrency safe
+//create a cache with n shards, n is rounded up to a power of 2
+func newCache(n int) *cache {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	res := &cache{
+		shards: make([]*shard, size),
+		mask:   uint32(size - 1),
+	}
+	for i := range res.shards {
+		res.shards[i] = &shard{overhead: DefaultEntryOverhead, total: &res.used}
+	}
+	return res
+}
+
+//select shard by fnv-1a hash of key
+func (c *cache) shardOf(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h&c.mask]
+}
+
+//add cache and evict if byte budget is exceeded, concurrency safe. nothing
+//happens if cache is closed
 func (c *cache) add(key string, val Value, ttl time.Duration) {
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	if c.lru == nil {
-		c.lru = &lru.LRUCache{
-			OnDroped: func(key interface{}, value interface{}) {
-				val := value.(Value)
-				c.nbytes -= int64(len(key.(string))) + int64(val.Len())
-			},
-		}
+	c.shardOf(key).add(key, val, ttl)
+	c.checkOverflow(key)
+}
+
+//add cache with a version larger than the one it replaces, return the version
+//added with. concurrency safe
+func (c *cache) addVersioned(key string, val Value, ttl time.Duration) uint64 {
+	version, _ := c.shardOf(key).addVersioned(key, val, ttl, 0, false)
+	c.checkOverflow(key)
+	return version
+}
+
+//add cache only if version of the entry of key is expected, 0 standing for no
+//entry. return version of the entry after the call and whether val is added.
+//concurrency safe
+func (c *cache) cas(key string, val Value, ttl time.Duration, expected uint64) (uint64, bool) {
+	version, ok := c.shardOf(key).addVersioned(key, val, ttl, expected, true)
+	if ok {
+		c.checkOverflow(key)
 	}
-	c.lru.Add(key, val, ttl)
-	c.nbytes += int64(len(key)) + int64(val.Len())
+	return version, ok
 }
 
 //get cache, concurrency safe
 func (c *cache) get(key string) (value Value, ok bool) {
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	if c.lru == nil {
-		return
+	return c.shardOf(key).get(key)
+}
+
+//get cache with its expiration, without counting as an access. concurrency
+//safe
+func (c *cache) peek(key string) (lru.Item[string, Value], bool) {
+	return c.shardOf(key).peek(key)
+}
+
+//del cache, concurrency safe
+func (c *cache) del(key string) {
+	c.shardOf(key).del(key)
+}
+
+//switch to sliding expiration: every hit pushes expiry forward by the ttl
+//passed to add, but never beyond maxLifetime after add. zero maxLifetime
+//means no limit. maxLifetime only applies to cache added afterwards
+func (c *cache) setSliding(maxLifetime time.Duration) {
+	for _, s := range c.shards {
+		s.setSliding(maxLifetime)
 	}
-	c.ngets++
-	entry, hit := c.lru.Get(key)
-	if !hit {
-		return
+}
+
+//call f with every entry evicted for exceeding byte budget, not with entries
+//deleted, expired or cleared. f is called with the shard locked, so it must
+//not block or touch cache
+func (c *cache) setOnEvict(f func(item lru.Item[string, Value])) {
+	for _, s := range c.shards {
+		s.setOnEvict(f)
 	}
-	c.nhits++
-	//delete if expired
-	if time.Now().After(entry.ExpireAt) {
-		c.lru.Del(entry.Key)
-		return Value{}, false
+}
+
+//switch eviction policy of all shards, cache already in cache is dropped
+func (c *cache) setPolicy(kind EvictionPolicy) {
+	for _, s := range c.shards {
+		s.setPolicy(kind)
 	}
+}
 
-	return entry.Val.(Value), true
+//evict one cache chosen by policy from the shard using most memory, return
+//bytes freed. return false if cache is empty
+func (c *cache) removeLeastUsed() (int64, bool) {
+	return c.evict("")
 }
 
-//del cache, concurrency safe
-func (c *cache) del(key string) {
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	if c.lru == nil {
-		return
+//evict until bytes of all shards fit into maxBytes. keep is the key just
+//added, see evict
+func (c *cache) checkOverflow(keep string) {
+	for {
+		maxBytes := atomic.LoadInt64(&c.maxBytes)
+		if maxBytes <= 0 || atomic.LoadInt64(&c.used) <= maxBytes {
+			return
+		}
+		if _, ok := c.evict(keep); !ok {
+			return
+		}
 	}
-	c.lru.Del(key)
 }
 
-//remove least recently used cache
-func (c *cache) removeLeastUsed() int64 {
-	c.rw.Lock()
-	defer c.rw.Unlock()
-	c.lru.RemoveLeastUsed()
-	return c.nbytes
+//evict one cache chosen by policy from the shard using most memory. the shard
+//of keep is passed over while keep is its only entry, so that a big entry
+//just added is not evicted in favor of smaller ones in other shards. it goes
+//only once it is all that is left
+func (c *cache) evict(keep string) (int64, bool) {
+	var kept, target *shard
+	if keep != "" {
+		if kept = c.shardOf(keep); kept.len() > 1 {
+			kept = nil
+		}
+	}
+	var most int64
+	for _, s := range c.shards {
+		if n := s.bytes(); n > most && s != kept {
+			target, most = s, n
+		}
+	}
+	if target == nil {
+		target = kept
+	}
+	if target == nil {
+		return 0, false
+	}
+	return target.removeLeastUsed()
+}
+
+//return memory usage of cache, concurrency safe
+func (c *cache) bytes() int64 {
+	return atomic.LoadInt64(&c.used)
+}
+
+//set byte budget of all shards together and evict if it is exceeded. every
+//shard sizes its policy for an even share of it. <= 0 means no limit
+func (c *cache) setMaxBytes(maxBytes int64) {
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	atomic.StoreInt64(&c.maxBytes, maxBytes)
+	c.setCapacity(maxBytes)
+	c.checkOverflow("")
 }
 
-//every [delTTL] millisecond, randomly select [delCount] cache and delect it when expire
+//set byte budget policies of shards are sized by, maxBytes by default. every
+//shard gets an equal share, 0 means their slabs start empty and grow without
+//limit
+func (c *cache) setCapacity(capacity int64) {
+	if capacity < 0 {
+		capacity = 0
+	}
+	for _, s := range c.shards {
+		s.setCapacity(capacity / int64(len(c.shards)))
+	}
+}
+
+//drop all cache, concurrency safe
+func (c *cache) clear() {
+	for _, s := range c.shards {
+		s.clear()
+	}
+}
+
+//set bytes counted for each entry besides its key and value. entries already
+//in cache are recounted
+func (c *cache) setOverhead(overhead int64) {
+	for _, s := range c.shards {
+		s.setOverhead(overhead)
+	}
+	c.checkOverflow("")
+}
+
+//every [delTTL] millisecond, delete all expired cache. expired cache is removed
+//in batches of at most [delCount], and the lock of a shard is released between
+//batches so that readers and writers are never blocked for long
 func (c *cache) timingDel() {
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		ticker := time.NewTicker(time.Duration(delTTL) * time.Millisecond)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				c.rw.Lock()
-				count := 0
-				for k, v := range c.lru.GetAllCache() {
-					//delete if expired
-					nodeEntry := v.Value.(*lru.Entry)
-					if time.Now().After(nodeEntry.ExpireAt) {
-						c.lru.Del(k)
-					}
-					count++
-					if count >= delCount {
-						break
+			case now := <-ticker.C:
+				for _, s := range c.shards {
+					for {
+						if s.removeExpired(now) < delCount {
+							break
+						}
 					}
 				}
-				c.rw.Unlock()
+			case <-c.stop:
+				return
 			}
 		}
 	}()
 }
+
+//stop background goroutine and drop all cache. a closed cache is always empty,
+//calling Close more than once is fine
+func (c *cache) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	if c.stop != nil {
+		close(c.stop)
+	}
+	c.mu.Unlock()
+
+	c.wg.Wait()
+	for _, s := range c.shards {
+		s.close()
+	}
+}
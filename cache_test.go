@@ -1,18 +1,1352 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/lru"
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+
+	"google.golang.org/protobuf/proto"
 )
 
 func TestCache(t *testing.T) {
 	//测试Add
 	c1 := NewCache()
-	c1.add("1", Value{}, 2*time.Second)
+	c1.add("1", Value{}, 200*time.Millisecond)
+	if _, ok := c1.get("1"); !ok {
+		t.Errorf("missing before expiry")
+	}
 	fmt.Println(time.Now())
 	time.Sleep(1 * time.Second)
 	if _, ok := c1.get("1"); ok {
 		t.Errorf("bug")
 	}
 }
+
+func TestGroupCacheClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		g := NewGroupCache("close", 1<<20, nil)
+		g.Add("k", []byte("v"), time.Minute)
+		DeleteGroupCache("close")
+		if GetGroupCache("close") != nil {
+			t.Fatalf("group not unregistered")
+		}
+		if _, err := g.Get("k", DefaultOption); err == nil {
+			t.Errorf("get on closed group succeeded")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: %d before, %d after", before, after)
+	}
+}
+
+func TestHttpPoolClose(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+
+	pool := NewHttpPool("self")
+	pool.AddPeers(strings.TrimPrefix(srv.URL, "http://"))
+	peer, ok := pool.PickPeer("key")
+	if !ok {
+		t.Fatal("no peer picked")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- peer.Get(&pb.GetRequest{Group: "g", Key: "key"}, &pb.GetResponse{})
+	}()
+	<-entered
+
+	//Close cancels the request in flight
+	pool.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("request in flight not cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request in flight not cancelled by Close")
+	}
+	if _, ok := pool.PickPeer("key"); ok {
+		t.Errorf("peer picked after Close")
+	}
+	pool.Close()
+}
+
+func TestCacheBytes(t *testing.T) {
+	c := newCache(1)
+	c.setOverhead(10)
+	c.add("a", Value{b: []byte("123")}, time.Minute)
+	c.add("b", Value{b: []byte("1")}, time.Minute)
+	c.add("a", Value{b: []byte("12345")}, time.Minute)
+	if got, want := c.bytes(), int64(1+5+10+1+1+10); got != want {
+		t.Errorf("got %d bytes but want %d", got, want)
+	}
+	c.del("b")
+	if freed, ok := c.removeLeastUsed(); !ok || freed != 16 {
+		t.Errorf("freed %d bytes but want 16", freed)
+	}
+	if _, ok := c.removeLeastUsed(); ok {
+		t.Errorf("evicted from empty cache")
+	}
+	if c.bytes() != 0 {
+		t.Errorf("got %d bytes after removing all", c.bytes())
+	}
+}
+
+func TestGroupCacheMaxBytes(t *testing.T) {
+	g := NewGroupCache("maxbytes", 1000, nil)
+	defer g.Close()
+	g.SetEntryOverhead(0)
+	for i := 0; i < 100; i++ {
+		g.Add(fmt.Sprintf("key%03d", i), make([]byte, 94), time.Minute)
+		if g.Bytes() > 1000 {
+			t.Fatalf("got %d bytes but max is 1000", g.Bytes())
+		}
+	}
+	if _, hit := g.mainCache.get("key099"); !hit {
+		t.Errorf("most recently added cache evicted")
+	}
+
+	//the budget is shared by all shards, an entry far larger than a share
+	//of it stays
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("big%d", i)
+		g.Add(key, bytes.Repeat([]byte{'x'}, 250-len(key)), time.Minute)
+		if val, err := g.Get(key, Option{FromLocal: true}); err != nil || val.Len() != 250-len(key) {
+			t.Errorf("got %d bytes of %v, %v", val.Len(), key, err)
+		}
+		if g.Bytes() > 1000 {
+			t.Fatalf("got %d bytes but max is 1000", g.Bytes())
+		}
+	}
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	for _, n := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			c := newCache(n)
+			for _, k := range keys {
+				c.add(k, Value{b: []byte(k)}, time.Hour)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					c.get(keys[i&1023])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for _, p := range []EvictionPolicy{PolicyLRU, PolicyLFU, PolicyTinyLFU, PolicyARC, Policy2Q, PolicyArena} {
+		g := NewGroupCache("policy", 16000, nil)
+		g.SetEvictionPolicy(p)
+		g.Add("k", []byte("v"), time.Minute)
+		if val, err := g.Get("k", Option{FromLocal: true}); err != nil || val.String() != "v" {
+			t.Errorf("%v: got %q, %v", p, val.String(), err)
+		}
+		for i := 0; i < 1000; i++ {
+			g.Add(fmt.Sprintf("%d", i), []byte("v"), time.Minute)
+		}
+		if g.Bytes() > 16000 {
+			t.Errorf("%v: got %d bytes over budget", p, g.Bytes())
+		}
+		g.Close()
+	}
+}
+
+func TestFrequencyAdmission(t *testing.T) {
+	a := FrequencyAdmission(3, time.Minute)
+	for i := 0; i < 2; i++ {
+		if a.Admit("k") {
+			t.Fatalf("admitted after %d requests", i+1)
+		}
+	}
+	if !a.Admit("k") {
+		t.Errorf("not admitted after 3 requests")
+	}
+	if a.Admit("other") {
+		t.Errorf("other key admitted on first request")
+	}
+}
+
+//peer answering every key with its own name
+type fakePeer struct{}
+
+func (fakePeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
+	setResponse(resp, []byte(req.GetKey()))
+	return nil
+}
+
+//set value of resp with its checksum, as peers send it
+func setResponse(resp *pb.GetResponse, b []byte) {
+	resp.Value = b
+	resp.Checksum = proto.Uint32(withChecksum(Value{b: b}).sum)
+}
+
+func (fakePeer) Addr() string { return "fake" }
+
+//picks fakePeer for every key
+type fakePicker struct{}
+
+func (fakePicker) PickPeer(key string) (Peer, bool) { return fakePeer{}, true }
+
+func TestHotCacheAdmission(t *testing.T) {
+	g := NewGroupCache("admission", 0, nil)
+	defer g.Close()
+	g.RegisterPeerPicker(fakePicker{})
+	g.SetHotCacheAdmission(FrequencyAdmission(2, time.Minute))
+	opt := Option{FromLocal: true, FromPeer: true, TTL: time.Minute}
+	for i := 0; i < 3; i++ {
+		if val, err := g.Get("k", opt); err != nil || val.String() != "k" {
+			t.Fatalf("got %q, %v", val.String(), err)
+		}
+	}
+	stats := g.Stats()
+	if stats.PeerLoads != 2 || stats.HotRejected != 1 || stats.HotAdmitted != 1 || stats.LocalHits != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	//concurrent Gets sharing one load count one by one
+	release := make(chan struct{})
+	shared := NewGroupCache("admission-shared", 0, nil)
+	defer shared.Close()
+	shared.RegisterPeerPicker(peerPicker{blockingPeer{release}})
+	shared.SetHotCacheAdmission(FrequencyAdmission(3, time.Minute))
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared.Get("k", opt)
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if st := shared.Stats(); st.HotAdmitted+st.HotRejected == 3 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	stats = shared.Stats()
+	if stats.PeerLoads != 1 || stats.HotAdmitted != 1 || stats.HotRejected != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+	if _, hit := shared.hotCache.get("k"); !hit {
+		t.Errorf("admitted value not in hotCache")
+	}
+}
+
+//peer answering every key with its own name once release is closed
+type blockingPeer struct {
+	release chan struct{}
+}
+
+func (p blockingPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
+	<-p.release
+	setResponse(resp, []byte(req.GetKey()))
+	return nil
+}
+
+func (blockingPeer) Addr() string { return "blocking" }
+
+//peer recording pushed hot keys
+type pushPeer struct {
+	pushed chan *pb.PushRequest
+}
+
+func (p pushPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error { return nil }
+
+func (p pushPeer) Addr() string { return "push" }
+
+func (p pushPeer) Push(req *pb.PushRequest) error {
+	p.pushed <- req
+	return nil
+}
+
+//owns every key, lists one pushPeer
+type ownerPicker struct{ peer pushPeer }
+
+func (o ownerPicker) PickPeer(key string) (Peer, bool) { return nil, false }
+
+func (o ownerPicker) AllPeers() []Peer { return []Peer{o.peer} }
+
+//owns no key, lists one pushPeer
+type remotePicker struct{ ownerPicker }
+
+func (r remotePicker) PickPeer(key string) (Peer, bool) { return r.peer, true }
+
+func TestHotKeyReplication(t *testing.T) {
+	g := NewGroupCache("hotkey", 0, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("v"), nil
+	}))
+	defer g.Close()
+	peer := pushPeer{pushed: make(chan *pb.PushRequest, 10)}
+	g.RegisterPeerPicker(ownerPicker{peer})
+	g.EnableHotKeyReplication(3, time.Minute)
+
+	opt := Option{FromLocal: true, FromGetter: true, TTL: time.Minute}
+	for i := 0; i < 5; i++ {
+		g.Get("hot", opt)
+	}
+	g.Get("cold", opt)
+
+	select {
+	case req := <-peer.pushed:
+		if req.GetKey() != "hot" || string(req.GetValue()) != "v" || req.GetTtl() <= 0 {
+			t.Errorf("got push %v", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hot key not pushed")
+	}
+	if hot := g.HotKeys(1); len(hot) != 1 || hot[0].Key != "hot" || hot[0].Count != 5 {
+		t.Errorf("got hot keys %+v", hot)
+	}
+
+	//a write on the owner pushes the new value over the replicas, keys never
+	//pushed are not
+	for _, key := range []string{"hot", "cold"} {
+		val, _ := g.Get(key, Option{FromLocal: true})
+		if _, err := g.CompareAndSet(key, val.Version(), []byte("7"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := g.Incr("hot", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	//pushes are sent concurrently, in any order
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case req := <-peer.pushed:
+			if req.GetKey() != "hot" {
+				t.Errorf("got push %v after write", req)
+			}
+			got[string(req.GetValue())] = true
+		case <-time.After(time.Second):
+			t.Fatal("written hot key not pushed again")
+		}
+	}
+	if !got["7"] || !got["8"] {
+		t.Errorf("got pushes of %v after writes", got)
+	}
+
+	//pushed at most once every interval, also when replication is
+	//reconfigured while keys are read
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				g.Get("hot", opt)
+			}
+		}()
+	}
+	g.EnableHotKeyReplication(3, time.Hour)
+	wg.Wait()
+	g.Close()
+	if n := len(peer.pushed); n != 0 {
+		t.Errorf("got %d more pushes", n)
+	}
+
+	g.receivePush("replica", Value{b: []byte("r")}, time.Minute)
+	if _, ok := g.hotCache.get("replica"); ok {
+		t.Errorf("push received after close")
+	}
+
+	//a node not owning a hot key neither pushes it nor keeps a record
+	g = NewGroupCache("hotkey", 0, nil)
+	defer g.Close()
+	g.RegisterPeerPicker(remotePicker{ownerPicker{peer}})
+	g.EnableHotKeyReplication(3, time.Minute)
+	for i := 0; i < 5; i++ {
+		g.Get("hot", opt)
+	}
+	g.pushed.Range(func(key, _ interface{}) bool {
+		t.Errorf("push record of %v kept by a non-owner", key)
+		return true
+	})
+	if n := len(peer.pushed); n != 0 {
+		t.Errorf("got %d pushes from a non-owner", n)
+	}
+}
+
+func TestCacheBudgets(t *testing.T) {
+	g := NewGroupCache("budgets", 64000, nil)
+	defer g.Close()
+	g.SetHotCacheRatio(0.25)
+	stats := g.Stats()
+	if stats.MainCache.MaxBytes != 48000 || stats.HotCache.MaxBytes != 16000 {
+		t.Fatalf("got budgets %v, %v", stats.MainCache.MaxBytes, stats.HotCache.MaxBytes)
+	}
+	//mainCache always keeps a share
+	g.SetHotCacheRatio(1)
+	if stats = g.Stats(); stats.MainCache.MaxBytes != 48000 || stats.HotCache.MaxBytes != 16000 {
+		t.Fatalf("got budgets %v, %v after ratio 1", stats.MainCache.MaxBytes, stats.HotCache.MaxBytes)
+	}
+
+	for i := 0; i < 100; i++ {
+		g.Add(fmt.Sprintf("main%d", i), []byte("v"), time.Minute)
+	}
+	//flood hotCache with replicas of remote keys
+	g.RegisterPeerPicker(fakePicker{})
+	opt := Option{FromLocal: true, FromPeer: true, TTL: time.Minute}
+	for i := 0; i < 1000; i++ {
+		g.Get(fmt.Sprintf("hot%d", i), opt)
+	}
+
+	stats = g.Stats()
+	if stats.MainCache.Items != 100 || stats.MainCache.Evictions != 0 {
+		t.Errorf("mainCache evicted by hotCache: %+v", stats.MainCache)
+	}
+	if stats.HotCache.Bytes > 16000 || stats.HotCache.Evictions == 0 {
+		t.Errorf("hotCache exceeds its budget: %+v", stats.HotCache)
+	}
+
+	g.SetCacheBudgets(48000, 0)
+	if _, err := g.Get("hot0", opt); err != nil || g.Stats().HotCache.Items != 0 {
+		t.Errorf("hotCache not disabled: %+v", g.Stats().HotCache)
+	}
+}
+
+func TestMemoryManager(t *testing.T) {
+	busy := NewGroupCache("busy", 0, nil)
+	defer busy.Close()
+	idle := NewGroupCache("idle", 0, nil)
+	defer idle.Close()
+	busy.SetWeight(3)
+	SetMemoryLimit(64000, 0)
+	defer SetMemoryLimit(0, 0)
+
+	//both idle and empty, split by weight
+	if b, i := busy.Stats().MainCache.MaxBytes, idle.Stats().MainCache.MaxBytes; b != 48000 || i != 16000 {
+		t.Fatalf("got budgets %v, %v", b, i)
+	}
+
+	//no group needs room, idle group keeps its share
+	idle.Add("k", bytes.Repeat([]byte("v"), 1000), time.Minute)
+	busy.Get("missing", Option{FromLocal: true})
+	Rebalance()
+	if b, i := busy.Stats().MainCache.MaxBytes, idle.Stats().MainCache.MaxBytes; b != 48000 || i != 16000 {
+		t.Fatalf("got budgets %v, %v with no demand", b, i)
+	}
+
+	//busy group fills its share, idle group is shrunk to make room
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%d", i)
+		busy.Add(key, []byte("v"), time.Minute)
+		busy.Get(key, Option{FromLocal: true})
+	}
+	Rebalance()
+	b, i := busy.Stats().MainCache.MaxBytes, idle.Stats().MainCache.MaxBytes
+	if b <= 48000 || i >= 16000 || b+i > 64000 {
+		t.Errorf("got budgets %v, %v after rebalance", b, i)
+	}
+	if busy.Bytes() > b {
+		t.Errorf("busy group uses %v bytes over budget %v", busy.Bytes(), b)
+	}
+
+	SetMemoryLimit(0, 0)
+	if b := busy.Stats().MainCache.MaxBytes; b != 0 {
+		t.Errorf("got budget %v after limit removed", b)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	g := NewGroupCache("serve", 0, GetterFunc(func(key string) ([]byte, error) {
+		if key == "empty" {
+			return nil, nil
+		}
+		return bytes.Repeat([]byte(key), 1000), nil
+	}))
+	defer g.Close()
+	pool := NewHttpPool("self")
+	defer pool.Close()
+	srv := httptest.NewServer(pool)
+	defer srv.Close()
+
+	peer := &httpPeer{remoteBaseUrl: srv.URL + defaultRoute}
+	for _, key := range []string{"k", "empty"} {
+		resp := &pb.GetResponse{}
+		if err := peer.Get(&pb.GetRequest{Group: "serve", Key: key}, resp); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := g.getter.Get(key)
+		if !bytes.Equal(resp.GetValue(), want) {
+			t.Errorf("got %d bytes for %q but want %d", len(resp.GetValue()), key, len(want))
+		}
+	}
+
+	val := Value{b: []byte("value")}
+	var buf bytes.Buffer
+	if n, err := val.WriteTo(&buf); err != nil || n != 5 || buf.String() != "value" {
+		t.Errorf("WriteTo got %d, %v, %q", n, err, buf.String())
+	}
+	dst := make([]byte, 3)
+	if n := val.CopyTo(dst); n != 3 || string(dst) != "val" {
+		t.Errorf("CopyTo got %d, %q", n, dst)
+	}
+}
+
+func TestStream(t *testing.T) {
+	big := bytes.Repeat([]byte("01234567"), 4*ChunkSize)
+	g := NewGroupCache("stream", 0, GetterFunc(func(key string) ([]byte, error) {
+		return big, nil
+	}))
+	defer g.Close()
+	pool := NewHttpPool("self")
+	defer pool.Close()
+	srv := httptest.NewServer(pool)
+	defer srv.Close()
+
+	peer := &httpPeer{remoteBaseUrl: srv.URL + defaultRoute}
+	val, err := getStream(peer, &pb.GetRequest{Group: "stream", Key: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(val.chunks) != len(big)/ChunkSize || !bytes.Equal(val.ByteSlice(), big) {
+		t.Errorf("got %d bytes in %d chunks", val.Len(), len(val.chunks))
+	}
+	r, err := g.GetReader("k", Option{FromLocal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n, err := io.Copy(io.Discard, r); err != nil || n != int64(len(big)) {
+		t.Errorf("read %d bytes, %v", n, err)
+	}
+	if item, _ := g.mainCache.peek("k"); len(item.Val.chunks) != len(big)/ChunkSize {
+		t.Errorf("value from Getter kept in %d chunks", len(item.Val.chunks))
+	}
+
+	//GetReader hands out chunks from peer as they arrive, the value goes to
+	//hotCache once the stream ends verified
+	client := NewGroupCache("streamclient", 0, nil)
+	defer client.Close()
+	for _, sum := range []uint32{checksum(&val), 1} {
+		client.RegisterPeerPicker(peerPicker{streamPeer{val: val, sum: sum}})
+		r, err = client.GetReader("k", DefaultOption)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(r, make([]byte, ChunkSize)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := client.hotCache.peek("k"); ok {
+			t.Errorf("cached before the stream ends")
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		_, cached := client.hotCache.get("k")
+		if sum == 1 {
+			if err != ErrChecksum || cached {
+				t.Errorf("corrupted value got %v, cached %v", err, cached)
+			}
+			continue
+		}
+		if err != nil || len(b) != len(big)-ChunkSize || !cached {
+			t.Errorf("read %d bytes, %v, cached %v", len(b), err, cached)
+		}
+		client.hotCache.del("k")
+	}
+
+	//corrupted and truncated streams are rejected
+	var buf bytes.Buffer
+	writeStream(&buf, val)
+	corrupted := buf.Bytes()
+	corrupted[frameHeaderSize+ChunkSize+frameHeaderSize+1] ^= 1
+	if _, err := readValue(newFrameReader(io.NopCloser(bytes.NewReader(corrupted)))); err != ErrChecksum {
+		t.Errorf("got %v on corrupted stream", err)
+	}
+	truncated := corrupted[:len(corrupted)-frameHeaderSize]
+	if _, err := readValue(newFrameReader(io.NopCloser(bytes.NewReader(truncated)))); err == nil {
+		t.Errorf("truncated stream accepted")
+	}
+}
+
+//peer streaming val in frames, with sum as its checksum
+type streamPeer struct {
+	val Value
+	sum uint32
+}
+
+func (p streamPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
+	resp.Value = p.val.bytes()
+	resp.Checksum = proto.Uint32(p.sum)
+	return nil
+}
+
+func (p streamPeer) GetStream(req *pb.GetRequest, resp *pb.GetResponse) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	writeStream(&buf, p.val)
+	resp.Checksum = proto.Uint32(p.sum)
+	return newFrameReader(io.NopCloser(&buf)), nil
+}
+
+func (streamPeer) Addr() string { return "stream" }
+
+func TestCompression(t *testing.T) {
+	record := bytes.Repeat([]byte(`{"course":"math","teacher":"li","capacity":100},`), 100)
+	for _, c := range []Compression{CompressionGzip, CompressionSnappy, CompressionZstd} {
+		g := NewGroupCache("compress", 0, GetterFunc(func(key string) ([]byte, error) {
+			return record, nil
+		}))
+		g.SetCompression(c, DefaultCompressThreshold)
+		g.Add("k", record, time.Minute)
+		if val, err := g.Get("k", Option{FromLocal: true}); err != nil || !bytes.Equal(val.ByteSlice(), record) {
+			t.Errorf("%v: got %d bytes, %v", c, val.Len(), err)
+		}
+		if n := g.Stats().MainCache.Bytes; n >= int64(len(record)) {
+			t.Errorf("%v: got %d bytes stored", c, n)
+		}
+
+		//peers get compressed bytes as they are
+		pool := NewHttpPool("self")
+		srv := httptest.NewServer(pool)
+		peer := &httpPeer{remoteBaseUrl: srv.URL + defaultRoute}
+		val, err := getStream(peer, &pb.GetRequest{Group: "compress", Key: "loaded"})
+		if err != nil || val.codec != c || val.Len() >= len(record) {
+			t.Errorf("%v: got %d bytes compressed by %v, %v", c, val.Len(), val.codec, err)
+		}
+		if val, err = decompressValue(val); err != nil || !bytes.Equal(val.ByteSlice(), record) {
+			t.Errorf("%v: got %d bytes after decompress, %v", c, val.Len(), err)
+		}
+		srv.Close()
+		pool.Close()
+		g.Close()
+	}
+
+	//compression may be switched while values are stored
+	g := NewGroupCache("compress", 0, nil)
+	defer g.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			g.SetCompression(Compression(i%2+1), DefaultCompressThreshold)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		g.Add(fmt.Sprint(i), record, time.Minute)
+	}
+	wg.Wait()
+	if val, err := g.Get("99", Option{FromLocal: true}); err != nil || !bytes.Equal(val.ByteSlice(), record) {
+		t.Errorf("got %d bytes, %v", val.Len(), err)
+	}
+}
+
+type course struct {
+	Name     string
+	Capacity int
+}
+
+//counts decoded objects
+type countingCodec[T any] struct {
+	Codec[T]
+	decoded *int
+}
+
+func (c countingCodec[T]) Unmarshal(b []byte) (T, error) {
+	*c.decoded++
+	return c.Codec.Unmarshal(b)
+}
+
+func TestTypedGroup(t *testing.T) {
+	want := course{"math", 100}
+	for name, codec := range map[string]Codec[course]{
+		"json":    JSONCodec[course]{},
+		"gob":     GobCodec[course]{},
+		"msgpack": MsgpackCodec[course]{},
+	} {
+		decoded := 0
+		tg := NewTypedGroupCache[course]("typed", 0, countingCodec[course]{codec, &decoded},
+			func(key string) (course, error) { return want, nil })
+		tg.EnableObjectCache(10, time.Minute)
+		for i := 0; i < 3; i++ {
+			if got, err := tg.Get("math", DefaultOption); err != nil || got != want {
+				t.Errorf("%s: got %+v, %v", name, got, err)
+			}
+		}
+		if decoded != 1 {
+			t.Errorf("%s: decoded %d times", name, decoded)
+		}
+		tg.Add("math", course{"math", 50}, time.Minute)
+		if got, _ := tg.Get("math", DefaultOption); got.Capacity != 50 {
+			t.Errorf("%s: got %+v after add", name, got)
+		}
+		//the object tier is local cache as well
+		if got, _ := tg.Get("math", Option{FromGetter: true}); got.Capacity != 100 {
+			t.Errorf("%s: got %+v from object tier without FromLocal", name, got)
+		}
+		//an object read before a write is not kept
+		writes := tg.writeCount()
+		tg.Add("math", course{"math", 40}, time.Minute)
+		tg.addObject("math", want, writes)
+		if got, _ := tg.Get("math", DefaultOption); got.Capacity != 40 {
+			t.Errorf("%s: got %+v after concurrent add", name, got)
+		}
+		tg.Group().Close()
+	}
+
+	tg := NewTypedGroup[*pb.GetRequest](NewGroupCache("typed", 0, nil), ProtoCodec[*pb.GetRequest]{})
+	defer tg.Group().Close()
+	tg.Add("req", &pb.GetRequest{Group: "g", Key: "k"}, time.Minute)
+	if got, err := tg.Get("req", Option{FromLocal: true}); err != nil || got.GetKey() != "k" {
+		t.Errorf("proto: got %v, %v", got, err)
+	}
+}
+
+//peer answering every key with a value not matching its checksum
+type corruptPeer struct{}
+
+func (corruptPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
+	resp.Value = []byte("truncated")
+	resp.Checksum = proto.Uint32(1)
+	return nil
+}
+
+func (corruptPeer) Addr() string { return "corrupt" }
+
+//peer answering every key with its own name but no checksum
+type uncheckedPeer struct{}
+
+func (uncheckedPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
+	resp.Value = []byte(req.GetKey())
+	return nil
+}
+
+func (uncheckedPeer) Addr() string { return "unchecked" }
+
+type corruptPicker struct{}
+
+func (corruptPicker) PickPeer(key string) (Peer, bool) { return corruptPeer{}, true }
+
+func TestChecksum(t *testing.T) {
+	g := NewGroupCache("checksum", 0, nil)
+	defer g.Close()
+	g.RegisterPeerPicker(corruptPicker{})
+	if _, err := g.Get("remote", Option{FromLocal: true, FromPeer: true}); err == nil {
+		t.Errorf("corrupted value from peer accepted")
+	}
+	if stats := g.Stats(); stats.ChecksumErrors != 1 || stats.HotCache.Items != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	//peers and pushes always carry a checksum, a value without one is corrupted
+	unchecked := NewGroupCache("checksum-unchecked", 0, nil)
+	defer unchecked.Close()
+	unchecked.RegisterPeerPicker(peerPicker{uncheckedPeer{}})
+	if _, err := unchecked.Get("remote", Option{FromLocal: true, FromPeer: true}); err == nil {
+		t.Errorf("value from peer without checksum accepted")
+	}
+	unchecked.receivePush("pushed", Value{b: []byte("v")}, time.Minute)
+	if _, ok := unchecked.hotCache.get("pushed"); ok {
+		t.Errorf("push without checksum accepted")
+	}
+	if stats := unchecked.Stats(); stats.ChecksumErrors != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	//flip a bit of a stored value
+	g.SetVerifyOnRead(true)
+	g.Add("local", []byte("value"), time.Minute)
+	item, _ := g.mainCache.peek("local")
+	item.Val.b[0] ^= 1
+	if val, err := g.Get("local", Option{FromLocal: true}); err != nil || val.Len() != 0 {
+		t.Errorf("got %q, %v from corrupted entry", val.String(), err)
+	}
+	if stats := g.Stats(); stats.ChecksumErrors != 2 || stats.MainCache.Items != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	keys := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	secret := []byte("student id 20230001")
+	for _, p := range []EvictionPolicy{PolicyLRU, PolicyArena} {
+		g := NewGroupCache("encrypt", 0, nil)
+		g.SetEvictionPolicy(p)
+		g.SetEncryption(keys)
+		g.Add("old", secret, time.Minute)
+		keys.Rotate("k2", bytes.Repeat([]byte{2}, 32))
+		g.Add("new", secret, time.Minute)
+
+		for _, key := range []string{"old", "new"} {
+			item, _ := g.mainCache.peek(key)
+			if bytes.Contains(item.Val.bytes(), secret) {
+				t.Errorf("%v: %s stored in plaintext", p, key)
+			}
+			if val, err := g.Get(key, Option{FromLocal: true}); err != nil || !bytes.Equal(val.ByteSlice(), secret) {
+				t.Errorf("%v: got %q, %v", p, val.String(), err)
+			}
+		}
+
+		keys.Forget("k1")
+		if _, err := g.Get("old", Option{FromLocal: true}); err == nil {
+			t.Errorf("%v: decrypted with forgotten key", p)
+		}
+		keys.Rotate("k1", bytes.Repeat([]byte{1}, 32))
+		g.Close()
+	}
+
+	//an id given another key gets a new AEAD
+	e := &encryptor{keys: keys}
+	a1, _ := e.aead("k1", bytes.Repeat([]byte{1}, 32))
+	a2, _ := e.aead("k1", bytes.Repeat([]byte{3}, 32))
+	if a1 == a2 {
+		t.Errorf("AEAD of an old key served for a new one")
+	}
+
+	//decoded objects are plaintext, no object tier while encrypted
+	g := NewGroupCache("encrypt", 0, nil)
+	defer g.Close()
+	g.SetEncryption(keys)
+	tg := NewTypedGroup[course](g, JSONCodec[course]{})
+	tg.EnableObjectCache(10, time.Minute)
+	tg.Add("math", course{"math", 100}, time.Minute)
+	if got, err := tg.Get("math", DefaultOption); err != nil || got.Capacity != 100 {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if tg.objects != nil {
+		t.Errorf("object tier enabled while encrypted")
+	}
+
+	//encryption is switched while values are written and read
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprint(i, j)
+				g.Add(key, secret, time.Minute)
+				if val, err := g.Get(key, Option{FromLocal: true}); err == nil && val.Len() != 0 && !bytes.Equal(val.ByteSlice(), secret) {
+					t.Errorf("got %q", val.String())
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		g.SetEncryption(nil)
+		g.SetEncryption(keys)
+	}
+	wg.Wait()
+}
+
+func TestSnapshot(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 3*ChunkSize+1)
+	for _, p := range []EvictionPolicy{PolicyLRU, PolicyArena} {
+		g := NewGroupCache("snapshot", 0, nil)
+		g.SetEvictionPolicy(p)
+		g.SetCompression(CompressionSnappy, DefaultCompressThreshold)
+		g.SetEncryption(NewKeyRing("k1", bytes.Repeat([]byte{1}, 32)))
+		g.Add("a", []byte("1"), time.Minute)
+		g.Add("big", big, time.Minute)
+		g.Add("expiring", []byte("2"), 50*time.Millisecond)
+		g.hotCache.add("hot", Value{b: []byte("3")}, time.Minute)
+
+		path := t.TempDir() + "/snapshot"
+		g.EnablePeriodicSnapshot(path, 0)
+		g.Close()
+
+		time.Sleep(100 * time.Millisecond)
+		g = NewGroupCache("snapshot", 0, nil)
+		g.SetEvictionPolicy(p)
+		g.SetCompression(CompressionSnappy, DefaultCompressThreshold)
+		g.SetEncryption(NewKeyRing("k1", bytes.Repeat([]byte{1}, 32)))
+		if n, err := g.RestoreFromFile(path); n != 3 || err != nil {
+			t.Errorf("%v: restored %d entries, %v", p, n, err)
+		}
+		for key, want := range map[string][]byte{"a": []byte("1"), "big": big} {
+			if val, err := g.Get(key, Option{FromLocal: true}); err != nil || !bytes.Equal(val.ByteSlice(), want) {
+				t.Errorf("%v: got %d bytes of %s, %v", p, val.Len(), key, err)
+			}
+		}
+		if _, ok := g.hotCache.get("hot"); !ok {
+			t.Errorf("%v: hot entry not restored to hotCache", p)
+		}
+		if _, ok := g.mainCache.get("expiring"); ok {
+			t.Errorf("%v: expired entry restored", p)
+		}
+
+		//a corrupted snapshot is rejected, entries before the corruption are kept
+		var buf bytes.Buffer
+		g.Snapshot(&buf)
+		b := buf.Bytes()
+		b[len(b)-10] ^= 0xff
+		c := NewCache()
+		if _, err := c.Restore(bytes.NewReader(b)); !errors.Is(err, ErrBadSnapshot) {
+			t.Errorf("%v: got %v restoring corrupted snapshot", p, err)
+		}
+		c.Close()
+		g.Close()
+	}
+}
+
+func TestDiskTier(t *testing.T) {
+	for _, p := range []EvictionPolicy{PolicyLRU, PolicyArena} {
+		loads := 0
+		g := NewGroupCache("disk", 0, GetterFunc(func(key string) ([]byte, error) {
+			loads++
+			return []byte("loaded " + key), nil
+		}))
+		g.SetEvictionPolicy(p)
+		g.SetCacheBudgets(4<<10, 0)
+		if err := g.EnableDiskTier(t.TempDir(), 1<<20); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			g.Add(fmt.Sprint(i), bytes.Repeat([]byte("v"), 100), time.Minute)
+		}
+		g.Add("deleted", []byte("old"), time.Minute)
+		g.Del("deleted")
+		if n := g.Stats().MainCache.Evictions; n == 0 {
+			t.Fatalf("%v: nothing evicted", p)
+		}
+
+		//evicted entries are served from disk and moved back, not loaded again
+		for i := 0; i < 100; i++ {
+			val, err := g.Get(fmt.Sprint(i), DefaultOption)
+			if err != nil || val.Len() != 100 {
+				t.Errorf("%v: got %q, %v", p, val.String(), err)
+			}
+		}
+		if s := g.Stats(); loads != 0 || s.DiskHits == 0 {
+			t.Errorf("%v: loaded %d times, %d disk hits", p, loads, s.DiskHits)
+		}
+		if val, _ := g.Get("deleted", DefaultOption); val.String() != "loaded deleted" {
+			t.Errorf("%v: got deleted value %q", p, val.String())
+		}
+
+		//a value written after the disk copy is never replaced by it
+		g.disk.evicted(lru.Item[string, Value]{Key: "raced", Val: Value{b: []byte("old")}, ExpireAt: time.Now().Add(time.Minute)})
+		g.mainCache.addVersioned("raced", Value{b: []byte("new")}, time.Minute)
+		if val, ok := g.lookupDisk("raced"); !ok || val.String() != "new" {
+			t.Errorf("%v: got %q from disk over a newer value", p, val.String())
+		}
+		if val, _ := g.mainCache.get("raced"); val.String() != "new" {
+			t.Errorf("%v: newer value replaced by %q", p, val.String())
+		}
+		g.Close()
+		//closing again does nothing
+		g.Close()
+	}
+}
+
+//a backing store counting batches, failing while down
+type fakeStore struct {
+	mu      sync.Mutex
+	data    map[string]string
+	batches int
+	down    bool
+}
+
+func (s *fakeStore) Set(key string, val []byte) error {
+	return s.WriteBatch([]WriteOp{{Key: key, Val: val}})
+}
+
+func (s *fakeStore) WriteBatch(ops []WriteOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("store down")
+	}
+	s.batches++
+	for _, op := range ops {
+		if op.Del {
+			delete(s.data, op.Key)
+		} else {
+			s.data[op.Key] = string(op.Val)
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.data[key]
+	return val, ok
+}
+
+func (s *fakeStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func TestWriteBehind(t *testing.T) {
+	store := &fakeStore{data: map[string]string{"course": "old"}}
+	getter := GetterFunc(func(key string) ([]byte, error) {
+		if val, ok := store.get(key); ok {
+			return []byte(val), nil
+		}
+		return nil, errors.New("not found")
+	})
+
+	//write-through: nothing is cached if the store fails
+	g := NewGroupCache("write", 0, getter)
+	g.RegisterSetter(store)
+	store.setDown(true)
+	if err := g.Set("course", []byte("new"), time.Minute); err == nil {
+		t.Errorf("write-through succeeded with store down")
+	}
+	store.setDown(false)
+	if val, _ := g.Get("course", DefaultOption); val.String() != "old" {
+		t.Errorf("got %q", val.String())
+	}
+	g.Set("course", []byte("new"), time.Minute)
+	if val, _ := store.get("course"); val != "new" {
+		t.Errorf("store got %q", val)
+	}
+	g.Close()
+
+	//write-behind: writes are coalesced, retried and kept in journal
+	journal := t.TempDir() + "/journal"
+	g = NewGroupCache("write", 0, getter)
+	g.RegisterSetter(store)
+	if err := g.EnableWriteBehind(WriteBehindOption{FlushInterval: time.Hour, JournalPath: journal}); err != nil {
+		t.Fatal(err)
+	}
+	store.setDown(true)
+	for i := 0; i < 10; i++ {
+		g.Set("course", []byte(fmt.Sprint("v", i)), time.Minute)
+	}
+	g.Set("seat", []byte("1"), time.Minute)
+	g.Delete("seat")
+	//queued writes are read back even if cache loses them
+	g.Del("course")
+	if val, _ := g.Get("course", DefaultOption); val.String() != "v9" {
+		t.Errorf("got %q before flush", val.String())
+	}
+	if _, err := g.Get("seat", DefaultOption); !errors.Is(err, ErrDeleted) {
+		t.Errorf("got %v for deleted key", err)
+	}
+	if err := g.Flush(); err == nil || g.PendingWrites() != 2 {
+		t.Errorf("flush with store down: %v, %d pending", err, g.PendingWrites())
+	}
+	g.Close()
+
+	//writes left in journal are flushed by the next run
+	store.setDown(false)
+	batches := store.batches
+	g = NewGroupCache("write", 0, getter)
+	g.RegisterSetter(store)
+	if err := g.EnableWriteBehind(WriteBehindOption{FlushInterval: time.Millisecond, JournalPath: journal}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && g.PendingWrites() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if val, _ := store.get("course"); val != "v9" || store.batches != batches+1 {
+		t.Errorf("store got %q in %d batches", val, store.batches-batches)
+	}
+	if _, ok := store.get("seat"); ok {
+		t.Errorf("deleted key in store")
+	}
+	g.Close()
+	if info, err := os.Stat(journal); err != nil || info.Size() != 0 {
+		t.Errorf("journal not truncated: %v, %v", info, err)
+	}
+	//closing again does nothing
+	g.Close()
+
+	//values are encrypted in journal as in cache
+	keys := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	secret := []byte("student id 20230001")
+	store.setDown(true)
+	g = NewGroupCache("write", 0, getter)
+	g.RegisterSetter(store)
+	g.SetEncryption(keys)
+	if err := g.EnableWriteBehind(WriteBehindOption{FlushInterval: time.Hour, JournalPath: journal}); err != nil {
+		t.Fatal(err)
+	}
+	g.Set("secret", secret, time.Minute)
+	g.Close()
+	if b, err := os.ReadFile(journal); err != nil || bytes.Contains(b, secret) {
+		t.Errorf("journal kept in plaintext: %v", err)
+	}
+	store.setDown(false)
+	g = NewGroupCache("write", 0, getter)
+	g.RegisterSetter(store)
+	if err := g.EnableWriteBehind(WriteBehindOption{JournalPath: journal}); err == nil {
+		t.Errorf("encrypted journal replayed without encryption")
+	}
+	g.SetEncryption(keys)
+	if err := g.EnableWriteBehind(WriteBehindOption{JournalPath: journal}); err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+	if val, _ := store.get("secret"); val != string(secret) {
+		t.Errorf("store got %q from encrypted journal", val)
+	}
+}
+
+type peerPicker struct{ peer Peer }
+
+func (p peerPicker) PickPeer(key string) (Peer, bool) { return p.peer, true }
+
+func TestCompareAndSet(t *testing.T) {
+	for _, p := range []EvictionPolicy{PolicyLRU, PolicyArena} {
+		g := NewGroupCache("cas", 0, nil)
+		g.SetEvictionPolicy(p)
+		g.Add("seats", []byte("10"), time.Minute)
+		val, _ := g.Get("seats", Option{FromLocal: true})
+		v1 := val.Version()
+		if v1 == 0 {
+			t.Fatalf("%v: got no version", p)
+		}
+
+		//only the first of two writers reading the same version wins
+		v2, err := g.CompareAndSet("seats", v1, []byte("9"), time.Minute)
+		if err != nil || v2 <= v1 {
+			t.Errorf("%v: got version %d after %d, %v", p, v2, v1, err)
+		}
+		if cur, err := g.CompareAndSet("seats", v1, []byte("9"), time.Minute); err != ErrVersionMismatch || cur != v2 {
+			t.Errorf("%v: got version %d, %v", p, cur, err)
+		}
+		if val, _ = g.Get("seats", Option{FromLocal: true}); val.String() != "9" || val.Version() != v2 {
+			t.Errorf("%v: got %q of version %d", p, val.String(), val.Version())
+		}
+		if _, err = g.CompareAndSet("new", 0, []byte("1"), time.Minute); err != nil {
+			t.Errorf("%v: %v setting a key not in cache", p, err)
+		}
+
+		//a non-owner forwards to the owner, which is itself here
+		pool := NewHttpPool("self")
+		srv := httptest.NewServer(pool)
+		g.RegisterPeerPicker(peerPicker{&httpPeer{remoteBaseUrl: srv.URL + defaultRoute}})
+		g.hotCache.add("seats", Value{b: []byte("10"), version: v1}, time.Minute)
+		if _, err = g.CompareAndSet("seats", v1, []byte("8"), time.Minute); err != ErrVersionMismatch {
+			t.Errorf("%v: forwarded stale write got %v", p, err)
+		}
+		if _, ok := g.hotCache.get("seats"); ok {
+			t.Errorf("%v: stale replica kept after mismatch", p)
+		}
+		v3, err := g.CompareAndSet("seats", v2, []byte("8"), time.Minute)
+		if val, _ = g.mainCache.get("seats"); err != nil || val.String() != "8" || val.Version() != v3 {
+			t.Errorf("%v: got %q of version %d after forwarding, %v", p, val.String(), val.Version(), err)
+		}
+		srv.Close()
+		pool.Close()
+		g.Close()
+	}
+
+	//a value cached while loading wins, and what was loaded has no version
+	//that was never cached
+	var g *GroupCache
+	g = NewGroupCache("cas", 0, GetterFunc(func(key string) ([]byte, error) {
+		g.mainCache.addVersioned(key, Value{b: []byte("cached")}, time.Minute)
+		return []byte("loaded"), nil
+	}))
+	defer g.Close()
+	val, err := g.Get("raced", Option{FromGetter: true, TTL: time.Minute})
+	cur, _ := g.mainCache.get("raced")
+	if err != nil || val.String() != "cached" || val.Version() != cur.Version() {
+		t.Errorf("got %q of version %d, cached version %d, %v", val.String(), val.Version(), cur.Version(), err)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	g := NewGroupCache("counter", 0, GetterFunc(func(key string) ([]byte, error) {
+		return []byte("30"), nil
+	}))
+	defer g.Close()
+
+	//concurrent decrements of seats loaded from Getter never go below zero
+	var wg sync.WaitGroup
+	var taken, refused int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := g.IncrBounded("seats", -1, Bounds{Min: 0, Max: 30}, time.Minute); err == nil {
+				atomic.AddInt64(&taken, 1)
+			} else if err == ErrOutOfBounds {
+				atomic.AddInt64(&refused, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 30 || refused != 20 {
+		t.Errorf("took %d seats, refused %d", taken, refused)
+	}
+	if val, _ := g.Get("seats", Option{FromLocal: true}); val.String() != "0" {
+		t.Errorf("got %q", val.String())
+	}
+	if n, err := g.Incr("seats", 5, time.Minute); n != 5 || err != nil {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	//a non-owner forwards to the owner, which is itself here
+	pool := NewHttpPool("self")
+	srv := httptest.NewServer(pool)
+	defer srv.Close()
+	defer pool.Close()
+	g.RegisterPeerPicker(peerPicker{&httpPeer{remoteBaseUrl: srv.URL + defaultRoute}})
+	if n, err := g.Decr("seats", 2, time.Minute); n != 3 || err != nil {
+		t.Errorf("got %d, %v after forwarding", n, err)
+	}
+	g.hotCache.add("seats", Value{b: []byte("5")}, time.Minute)
+	if n, err := g.IncrBounded("seats", -4, Bounds{Min: 0, Max: math.MaxInt64}, time.Minute); n != 3 || err != ErrOutOfBounds {
+		t.Errorf("got %d, %v after forwarding", n, err)
+	}
+	if _, ok := g.hotCache.get("seats"); ok {
+		t.Errorf("stale replica kept after out of bounds")
+	}
+	if n, err := g.Incr("seats", math.MaxInt64, time.Minute); n != 3 || err != ErrOutOfBounds {
+		t.Errorf("got %d, %v on overflow", n, err)
+	}
+	body, _ := proto.Marshal(&pb.IncrRequest{Group: "counter", Key: strings.Repeat("k", maxIncrBytes), Delta: 1})
+	resp, err := http.Post(srv.URL+defaultRoute+incrRoute, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a large body", resp.StatusCode)
+	}
+}
+
+func TestLease(t *testing.T) {
+	g := NewGroupCache("lease", 0, nil)
+	defer g.Close()
+
+	//only the first miss gets the lease
+	first, err := g.GetWithLease("course")
+	if err != nil || first.Token == 0 {
+		t.Fatalf("got %+v, %v", first, err)
+	}
+	if res, _ := g.GetWithLease("course"); !res.Wait || res.Token != 0 || res.Stale {
+		t.Errorf("got %+v while lease is out", res)
+	}
+	if err = g.SetWithLease("course", first.Token+1, []byte("v0"), time.Minute); err != ErrLeaseInvalid {
+		t.Errorf("got %v with a wrong token", err)
+	}
+	if err = g.SetWithLease("course", first.Token, []byte("v1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := g.GetWithLease("course"); res.Token != 0 || res.Wait || res.Value.String() != "v1" {
+		t.Errorf("got %+v after fill", res)
+	}
+
+	//a deleted value is served as stale while the key is refilled
+	g.Del("course")
+	holder, _ := g.GetWithLease("course")
+	waiter, _ := g.GetWithLease("course")
+	if holder.Token == 0 || !holder.Stale || holder.Value.String() != "v1" {
+		t.Errorf("got %+v after delete", holder)
+	}
+	if !waiter.Wait || !waiter.Stale || waiter.Value.String() != "v1" {
+		t.Errorf("got %+v while refilling", waiter)
+	}
+
+	//a write after the lease is granted voids it
+	g.Add("course", []byte("v2"), time.Minute)
+	if err = g.SetWithLease("course", holder.Token, []byte("v1"), time.Minute); err != ErrLeaseInvalid {
+		t.Errorf("got %v after invalidation", err)
+	}
+	if val, _ := g.Get("course", DefaultOption); val.String() != "v2" {
+		t.Errorf("got %q, stale set overwrote a newer value", val.String())
+	}
+
+	//a lease whose holder never fills expires
+	g.SetLeaseTTL(10*time.Millisecond, 0)
+	g.Del("course")
+	lost, _ := g.GetWithLease("course")
+	time.Sleep(20 * time.Millisecond)
+	next, _ := g.GetWithLease("course")
+	if next.Token == 0 || next.Token == lost.Token || next.Stale {
+		t.Errorf("got %+v after lease expired", next)
+	}
+	if err = g.SetWithLease("course", lost.Token, []byte("v3"), time.Minute); err != ErrLeaseInvalid {
+		t.Errorf("got %v with an expired lease", err)
+	}
+	g.SetLeaseTTL(DefaultLeaseTTL, DefaultStaleTTL)
+
+	//a non-owner forwards to the owner, which is itself here
+	pool := NewHttpPool("self")
+	srv := httptest.NewServer(pool)
+	defer srv.Close()
+	defer pool.Close()
+	g.RegisterPeerPicker(peerPicker{&httpPeer{remoteBaseUrl: srv.URL + defaultRoute}})
+	g.Del("teacher")
+	res, err := g.GetWithLease("teacher")
+	if err != nil || res.Token == 0 {
+		t.Fatalf("got %+v, %v after forwarding", res, err)
+	}
+	if res, _ := g.GetWithLease("teacher"); !res.Wait {
+		t.Errorf("got %+v after forwarding", res)
+	}
+	if err = g.SetWithLease("teacher", res.Token, []byte("li"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = g.SetWithLease("teacher", res.Token, []byte("wang"), time.Minute); err != ErrLeaseInvalid {
+		t.Errorf("got %v filling twice", err)
+	}
+	if res, _ := g.GetWithLease("teacher"); res.Value.String() != "li" {
+		t.Errorf("got %+v after forwarding", res)
+	}
+
+	stats := g.Stats()
+	if stats.LeasesGranted != 5 || stats.LeaseWaits != 3 || stats.LeaseRejects != 4 {
+		t.Errorf("got %+v", stats)
+	}
+
+	//a delete on another node voids the lease on the owner. both nodes run the
+	//same group, the other one is unregistered so that pool serves the owner
+	other := NewGroupCache("lease2", 0, nil)
+	defer other.Close()
+	rw.Lock()
+	delete(groups, "lease2")
+	rw.Unlock()
+	owner := NewGroupCache("lease2", 0, nil)
+	defer owner.Close()
+	other.RegisterSetter(&fakeStore{data: map[string]string{}})
+	other.RegisterPeerPicker(peerPicker{&httpPeer{remoteBaseUrl: srv.URL + defaultRoute}})
+	res, err = other.GetWithLease("course")
+	if err != nil || res.Token == 0 {
+		t.Fatalf("got %+v, %v from owner", res, err)
+	}
+	if err = other.Delete("course"); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.SetWithLease("course", res.Token, []byte("stale"), time.Minute); err != ErrLeaseInvalid {
+		t.Errorf("got %v after a delete on another node", err)
+	}
+	if _, ok := owner.mainCache.get("course"); ok {
+		t.Errorf("stale value filled on owner")
+	}
+}
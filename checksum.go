@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"hash/crc32"
+
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//compute crc32c of value as stored, chunks included
+func checksum(val *Value) uint32 {
+	var sum uint32
+	val.eachChunk(ChunkSize, func(chunk []byte) error {
+		sum = crc32.Update(sum, crcTable, chunk)
+		return nil
+	})
+	return sum
+}
+
+//return val with its checksum, computed if not yet
+func withChecksum(val Value) Value {
+	if !val.summed {
+		val.sum, val.summed = checksum(&val), true
+	}
+	return val
+}
+
+//whether val matches its checksum, a value without checksum always matches
+func verify(val *Value) bool {
+	return !val.summed || checksum(val) == val.sum
+}
+
+//whether a value from a peer or a push matches its checksum. peers always send
+//one, so a value without checksum is taken as corrupted. an empty value is
+//sent without any field and needs none
+func verifyPeer(val *Value) bool {
+	return val.Len() == 0 || val.summed && checksum(val) == val.sum
+}
+
+//verify values read from mainCache and hotCache against their checksums.
+//corrupted entries are dropped, counted in Stats.ChecksumErrors and treated
+//as misses. values from peers are always verified, off by default since it
+//reads every value once more. concurrency safe
+func (g *GroupCache) SetVerifyOnRead(on bool) {
+	g.verifyOnRead.Store(on)
+}
+
+//count and log a value failing its checksum
+func (g *GroupCache) corrupted(key string, from string) {
+	inc(&g.stats.checksumErrors)
+	logger.GetInstance().WithFields(logrus.Fields{
+		"group": g.name,
+		"key":   key,
+		"from":  from,
+	}).Errorln("value does not match its checksum")
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+//compression algorithm of values, selectable per GroupCache. the number is
+//also the flag carried in the wire format, do not reorder
+type Compression int32
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionSnappy
+	CompressionZstd
+)
+
+//values shorter than it are not compressed unless told otherwise, see
+//GroupCache.SetCompression
+const DefaultCompressThreshold = 256
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", int32(c))
+}
+
+var (
+	//zstd encoder and decoder are safe for concurrent EncodeAll/DecodeAll and
+	//expensive to create, so they are shared
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+//compress b, return error if c is unknown
+func compress(c Compression, b []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return b, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, b), nil
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %v", c)
+}
+
+//decompress b compressed by c
+func decompress(c Compression, b []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return b, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CompressionSnappy:
+		return snappy.Decode(nil, b)
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(b, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %v", c)
+}
+
+//compression set by GroupCache.SetCompression, replaced as a whole
+type compressConfig struct {
+	codec     Compression
+	threshold int //values of fewer bytes are stored as they are
+}
+
+//compress val with c if it is at least threshold bytes and gets smaller.
+//val is returned as is otherwise
+func compressValue(c Compression, threshold int, val Value) Value {
+	if c == CompressionNone || val.codec != CompressionNone || val.Len() < threshold {
+		return val
+	}
+	b, err := compress(c, val.bytes())
+	if err != nil || len(b) >= val.Len() {
+		return val
+	}
+	return Value{b: b, codec: c, version: val.version}
+}
+
+//return val decompressed, val is returned as is if not compressed
+func decompressValue(val Value) (Value, error) {
+	if val.codec == CompressionNone {
+		return val, nil
+	}
+	b, err := decompress(val.codec, val.bytes())
+	if err != nil {
+		return Value{}, fmt.Errorf("decompress %v value failed: %v", val.codec, err)
+	}
+	return Value{b: b, version: val.version}, nil
+}
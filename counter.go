@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+	"github.com/hollowdjj/course-selecting-sys/cache/singleshot"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/protobuf/proto"
+)
+
+//bounds a counter is kept within, both inclusive, see IncrBounded
+type Bounds struct {
+	Min, Max int64
+}
+
+//no bounds but those of int64
+var NoBounds = Bounds{Min: math.MinInt64, Max: math.MaxInt64}
+
+//the result of Incr would leave the counter out of bounds, or overflow int64.
+//the counter is not changed
+var ErrOutOfBounds = errors.New("dcache: counter out of bounds")
+
+//add delta to the counter of key and return its new value. a counter is a
+//value holding an int64 in decimal, so Get reads it as "42". a counter not in
+//cache starts from the value Getter returns for key, or 0 without Getter. the
+//addition is atomic and happens on the owner of key, forwarded through a Peer
+//implementing CounterPeer if it is not this node. replicas the owner pushed as
+//a hot key are pushed the new value. like Add, only cache is written
+func (g *GroupCache) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	return g.IncrBounded(key, delta, NoBounds, ttl)
+}
+
+//subtract delta from the counter of key, see Incr
+func (g *GroupCache) Decr(key string, delta int64, ttl time.Duration) (int64, error) {
+	return g.IncrBounded(key, -delta, NoBounds, ttl)
+}
+
+//same as Incr, but the counter never leaves b: if it would, the counter is
+//not changed and its current value is returned with ErrOutOfBounds. say
+//Bounds{Min: 0, Max: math.MaxInt64} for seats never going below zero
+func (g *GroupCache) IncrBounded(key string, delta int64, b Bounds, ttl time.Duration) (int64, error) {
+	if key == "" {
+		return 0, errors.New("key requied inorder to set cache")
+	}
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			return g.incrOnPeer(peer, key, delta, b, ttl)
+		}
+	}
+	return g.incrLocal(key, delta, b, ttl)
+}
+
+//Incr on this node, which owns key. it is a compare-and-set loop over the
+//version of the counter, so it never blocks other keys of the shard
+func (g *GroupCache) incrLocal(key string, delta int64, b Bounds, ttl time.Duration) (int64, error) {
+	for {
+		cur, version, err := g.counter(key)
+		if err != nil {
+			return 0, err
+		}
+		next := cur + delta
+		if (delta > 0 && next < cur) || (delta < 0 && next > cur) || next < b.Min || next > b.Max {
+			return cur, ErrOutOfBounds
+		}
+		val, err := g.store(key, Value{b: strconv.AppendInt(nil, next, 10), version: g.nextVersion()})
+		if err != nil {
+			return 0, err
+		}
+		found, ok := g.mainCache.cas(key, val, ttl, version)
+		if ok {
+			//a load of key under way must not overwrite the counter
+			atomic.AddUint64(g.writeSeq(key), 1)
+			g.voidLease(key, Value{}, false)
+			g.dropFromDisk(key)
+			g.checkOverflow()
+			g.repush(key)
+			return next, nil
+		}
+		if found == version {
+			//not a mismatch, cache refuses writes once closed
+			return 0, singleshot.ErrClosed
+		}
+	}
+}
+
+//current value of the counter of key and its version, 0 if not in cache.
+//the initial value comes from Getter
+func (g *GroupCache) counter(key string) (int64, uint64, error) {
+	item, ok := g.mainCache.peek(key)
+	if !ok {
+		if _, ok = g.lookupDisk(key); ok {
+			item, ok = g.mainCache.peek(key)
+		}
+	}
+	if !ok {
+		val, err := g.getFromGetter(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, err := parseCounter(key, val)
+		return n, 0, err
+	}
+	val, err := g.open(key, item.Val)
+	if err == nil {
+		val, err = decompressValue(val)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := parseCounter(key, val)
+	return n, item.Val.version, err
+}
+
+//int64 in val, an empty value is 0
+func parseCounter(key string, val Value) (int64, error) {
+	s := strings.TrimSpace(val.String())
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of key [%v] is not a counter: %v", key, err)
+	}
+	return n, nil
+}
+
+//forward Incr to peer owning key
+func (g *GroupCache) incrOnPeer(peer Peer, key string, delta int64, b Bounds, ttl time.Duration) (int64, error) {
+	counterPeer, ok := peer.(CounterPeer)
+	if !ok {
+		return 0, fmt.Errorf("peer [%v] does not support Incr", peer.Addr())
+	}
+	req := &pb.IncrRequest{
+		Group: g.name,
+		Key:   key,
+		Delta: delta,
+		Ttl:   ttl.Milliseconds(),
+	}
+	if b.Min != math.MinInt64 {
+		req.Min = proto.Int64(b.Min)
+	}
+	if b.Max != math.MaxInt64 {
+		req.Max = proto.Int64(b.Max)
+	}
+	resp := &pb.IncrResponse{}
+	if err := counterPeer.Incr(req, resp); err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   key,
+			"peer":  peer.Addr(),
+			"err":   err,
+		}).Errorln("incr on peer failed")
+		return 0, fmt.Errorf("incr on peer [%v] failed: %v", peer.Addr(), err)
+	}
+	//the replica here is stale now, or may be if the counter is out of bounds
+	g.hotCache.del(key)
+	if resp.GetOutOfBounds() {
+		return resp.GetValue(), ErrOutOfBounds
+	}
+	return resp.GetValue(), nil
+}
+
+//bounds of an IncrRequest
+func boundsOf(req *pb.IncrRequest) Bounds {
+	b := NoBounds
+	if req.Min != nil {
+		b.Min = req.GetMin()
+	}
+	if req.Max != nil {
+		b.Max = req.GetMax()
+	}
+	return b
+}
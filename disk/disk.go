@@ -0,0 +1,397 @@
+//Package disk is a cache keeping entries in append-only segment files on the
+//local filesystem, used as a second tier under memory. only the index lives
+//in memory; deleted, overwritten and expired entries leave dead bytes behind,
+//which are reclaimed by compacting segments or dropping the oldest segment
+//once the byte budget is exceeded.
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//layout of a record in a segment file:
+//	crc uint32 | expireAt int64 | keyLen uint32 | valLen uint32 | key | val
+//crc is crc32c of everything after it
+const headerSize = 4 + 8 + 4 + 4
+
+//suffix of segment files
+const segmentExt = ".seg"
+
+//bounds of segment size, which is 1/8 of byte budget
+const (
+	minSegmentSize = 64 << 10
+	maxSegmentSize = 64 << 20
+)
+
+//a segment whose live bytes are less than 1/compactRatio of its size is
+//compacted instead of dropped
+const compactRatio = 2
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//disk cache is closed
+var ErrClosed = errors.New("disk: cache closed")
+
+//statistics of a disk cache
+type Stats struct {
+	Items     int64 //number of entries
+	Bytes     int64 //bytes of segment files, dead bytes included
+	MaxBytes  int64 //byte budget
+	Gets      int64 //lookups
+	Hits      int64 //lookups that hit
+	Evictions int64 //live entries dropped with their segment
+	Corrupted int64 //entries failing their checksum on read, dropped
+}
+
+//an append-only segment file
+type segment struct {
+	id   uint64
+	f    *os.File
+	size int64 //bytes written
+	live int64 //bytes of records still indexed
+}
+
+//where the record of a key is
+type location struct {
+	seg      *segment
+	off      int64
+	size     int64 //bytes of the whole record
+	expireAt int64 //unix nano
+}
+
+//a cache of byte values in segment files under one directory. entries are
+//appended to the active segment; once segments take more than the budget, the
+//oldest ones are compacted if mostly dead, or dropped with their entries
+//otherwise, which makes eviction roughly FIFO. concurrency safe
+type Cache struct {
+	dir      string
+	maxBytes int64
+	segSize  int64
+
+	mu     sync.RWMutex
+	segs   []*segment //oldest first, the last one is active
+	index  map[string]location
+	bytes  int64 //sum of size of segs
+	nextID uint64
+	closed bool
+
+	gets, hits, evictions, corrupted int64 //accessed atomically
+}
+
+//open a disk cache in dir, which is created if not exist and should be used
+//by this cache only. a disk cache always starts empty: segment files left in
+//dir are removed. maxBytes bounds bytes of segment files
+func Open(dir string, maxBytes int64) (*Cache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("disk: byte budget %d must be positive", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range old {
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	segSize := maxBytes / 8
+	if segSize < minSegmentSize {
+		segSize = minSegmentSize
+	}
+	if segSize > maxSegmentSize {
+		segSize = maxSegmentSize
+	}
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		segSize:  segSize,
+		index:    make(map[string]location),
+	}
+	if err = c.rotate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//path of segment file id
+func (c *Cache) path(id uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016x%s", id, segmentExt))
+}
+
+//start a new active segment, lock must be held
+func (c *Cache) rotate() error {
+	f, err := os.OpenFile(c.path(c.nextID), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	c.segs = append(c.segs, &segment{id: c.nextID, f: f})
+	c.nextID++
+	return nil
+}
+
+//the segment being appended to, lock must be held
+func (c *Cache) active() *segment {
+	return c.segs[len(c.segs)-1]
+}
+
+//write entry expiring at expireAt. an expired entry and an entry taking more
+//than half of the budget are not written, an old entry of key is deleted
+//anyway
+func (c *Cache) Put(key string, val []byte, expireAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.unlink(key)
+	size := int64(headerSize + len(key) + len(val))
+	if !expireAt.After(time.Now()) || size > c.maxBytes/2 {
+		return nil
+	}
+	if err := c.append(key, val, expireAt.UnixNano()); err != nil {
+		return err
+	}
+	if c.bytes > c.maxBytes {
+		return c.makeRoom()
+	}
+	return nil
+}
+
+//append a record to the active segment and index it, lock must be held
+func (c *Cache) append(key string, val []byte, expireAt int64) error {
+	size := int64(headerSize + len(key) + len(val))
+	if seg := c.active(); seg.size > 0 && seg.size+size > c.segSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, size)
+	binary.BigEndian.PutUint64(b[4:], uint64(expireAt))
+	binary.BigEndian.PutUint32(b[12:], uint32(len(key)))
+	binary.BigEndian.PutUint32(b[16:], uint32(len(val)))
+	copy(b[headerSize:], key)
+	copy(b[headerSize+len(key):], val)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+
+	seg := c.active()
+	if _, err := seg.f.WriteAt(b, seg.size); err != nil {
+		return err
+	}
+	c.index[key] = location{seg: seg, off: seg.size, size: size, expireAt: expireAt}
+	seg.size += size
+	seg.live += size
+	c.bytes += size
+	return nil
+}
+
+//look up entry, return its value and expiration. an expired entry is a miss,
+//an entry failing its checksum is dropped and treated as a miss
+func (c *Cache) Get(key string) (val []byte, expireAt time.Time, ok bool) {
+	atomic.AddInt64(&c.gets, 1)
+	c.mu.RLock()
+	loc, hit := c.index[key]
+	if !hit || c.closed || loc.expireAt <= time.Now().UnixNano() {
+		c.mu.RUnlock()
+		return nil, expireAt, false
+	}
+	val, err := c.read(key, loc)
+	c.mu.RUnlock()
+	if err != nil {
+		atomic.AddInt64(&c.corrupted, 1)
+		c.mu.Lock()
+		if cur, ok := c.index[key]; ok && cur == loc {
+			c.unlink(key)
+		}
+		c.mu.Unlock()
+		return nil, expireAt, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return val, time.Unix(0, loc.expireAt), true
+}
+
+//read and verify the record of key at loc, read lock must be held
+func (c *Cache) read(key string, loc location) ([]byte, error) {
+	b := make([]byte, loc.size)
+	if _, err := loc.seg.f.ReadAt(b, loc.off); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(b) != crc32.Checksum(b[4:], crcTable) {
+		return nil, fmt.Errorf("disk: record of %v fails its checksum", key)
+	}
+	keyLen := int(binary.BigEndian.Uint32(b[12:]))
+	if headerSize+keyLen > len(b) || string(b[headerSize:headerSize+keyLen]) != key {
+		return nil, fmt.Errorf("disk: record at %d is not of %v", loc.off, key)
+	}
+	return b[headerSize+keyLen:], nil
+}
+
+//delete entry, return false if not exist
+func (c *Cache) Del(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unlink(key)
+}
+
+//remove key from index, its record becomes dead bytes. lock must be held
+func (c *Cache) unlink(key string) bool {
+	loc, ok := c.index[key]
+	if ok {
+		delete(c.index, key)
+		loc.seg.live -= loc.size
+	}
+	return ok
+}
+
+//reclaim bytes until segments take no more than 7/8 of the budget, so that the
+//work is amortized over writes. the oldest segment is compacted if mostly
+//dead, dropped otherwise. lock must be held
+func (c *Cache) makeRoom() error {
+	c.removeExpired(time.Now())
+	for c.bytes > c.maxBytes-c.maxBytes/8 && len(c.segs) > 1 {
+		oldest := c.segs[0]
+		if oldest.live*compactRatio < oldest.size {
+			if err := c.compact(oldest); err != nil {
+				return err
+			}
+			continue
+		}
+		c.drop(oldest, true)
+	}
+	return nil
+}
+
+//unlink every expired entry, lock must be held
+func (c *Cache) removeExpired(now time.Time) {
+	for key, loc := range c.index {
+		if loc.expireAt <= now.UnixNano() {
+			c.unlink(key)
+		}
+	}
+}
+
+//move live records of seg to the active segment, then drop seg. a record
+//failing its checksum is dropped. lock must be held
+func (c *Cache) compact(seg *segment) error {
+	for key, loc := range c.index {
+		if loc.seg != seg {
+			continue
+		}
+		b, err := c.read(key, loc)
+		c.unlink(key)
+		if err != nil {
+			atomic.AddInt64(&c.corrupted, 1)
+			continue
+		}
+		if err = c.append(key, b, loc.expireAt); err != nil {
+			return err
+		}
+	}
+	c.drop(seg, false)
+	return nil
+}
+
+//unlink entries of seg, then close and remove its file. lock must be held
+func (c *Cache) drop(seg *segment, evict bool) {
+	if seg.live > 0 {
+		for key, loc := range c.index {
+			if loc.seg == seg {
+				c.unlink(key)
+				if evict {
+					atomic.AddInt64(&c.evictions, 1)
+				}
+			}
+		}
+	}
+	for i, s := range c.segs {
+		if s == seg {
+			c.segs = append(c.segs[:i], c.segs[i+1:]...)
+			break
+		}
+	}
+	c.bytes -= seg.size
+	seg.f.Close()
+	os.Remove(seg.f.Name())
+}
+
+//reclaim dead bytes of every segment but the active one whose live bytes
+//are less than half of its size, and unlink expired entries
+func (c *Cache) Compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.removeExpired(time.Now())
+	for _, seg := range append([]*segment(nil), c.segs[:len(c.segs)-1]...) {
+		if seg.live*compactRatio < seg.size {
+			if err := c.compact(seg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//return number of entries
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.index)
+}
+
+//return bytes of segment files, dead bytes included
+func (c *Cache) Bytes() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bytes
+}
+
+//return statistics of cache
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Stats{
+		Items:     int64(len(c.index)),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+		Gets:      atomic.LoadInt64(&c.gets),
+		Hits:      atomic.LoadInt64(&c.hits),
+		Evictions: atomic.LoadInt64(&c.evictions),
+		Corrupted: atomic.LoadInt64(&c.corrupted),
+	}
+}
+
+//close and remove all segment files. a closed cache is always empty
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	var err error
+	for _, seg := range c.segs {
+		if cerr := seg.f.Close(); err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(seg.f.Name()); err == nil {
+			err = rerr
+		}
+	}
+	c.segs = nil
+	c.index = nil
+	c.bytes = 0
+	return err
+}
@@ -0,0 +1,76 @@
+package disk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := bytes.Repeat([]byte("v"), 1000)
+	for i := 0; i < 100; i++ {
+		c.Put(strconv.Itoa(i), val, time.Now().Add(time.Minute))
+	}
+	c.Put("short", val, time.Now().Add(time.Millisecond))
+	c.Del("1")
+	time.Sleep(2 * time.Millisecond)
+	if got, _, ok := c.Get("0"); !ok || !bytes.Equal(got, val) {
+		t.Errorf("got %d bytes, %v", len(got), ok)
+	}
+	for _, key := range []string{"1", "short"} {
+		if _, _, ok := c.Get(key); ok {
+			t.Errorf("get %s deleted or expired", key)
+		}
+	}
+
+	//segments are kept within budget, the oldest entries go first
+	for i := 100; i < 3000; i++ {
+		c.Put(strconv.Itoa(i), val, time.Now().Add(time.Minute))
+	}
+	if c.Bytes() > 1<<20 {
+		t.Errorf("got %d bytes on disk", c.Bytes())
+	}
+	if _, _, ok := c.Get("2"); ok {
+		t.Errorf("oldest entry not evicted")
+	}
+	if _, _, ok := c.Get("2999"); !ok {
+		t.Errorf("newest entry evicted")
+	}
+
+	//overwritten entries are compacted instead of dropped
+	for i := 0; i < 3; i++ {
+		for j := 2900; j < 3000; j++ {
+			c.Put(strconv.Itoa(j), val, time.Now().Add(time.Minute))
+		}
+	}
+	before := c.Bytes()
+	if err = c.Compact(); err != nil || c.Bytes() >= before {
+		t.Errorf("got %d bytes after compaction from %d, %v", c.Bytes(), before, err)
+	}
+	if _, _, ok := c.Get("2900"); !ok {
+		t.Errorf("live entry lost on compaction")
+	}
+
+	//a corrupted record is dropped on read
+	loc := c.index["2999"]
+	loc.seg.f.WriteAt([]byte("x"), loc.off+headerSize+4)
+	if _, _, ok := c.Get("2999"); ok || c.Stats().Corrupted != 1 {
+		t.Errorf("got corrupted entry, stats %+v", c.Stats())
+	}
+
+	c.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt)); len(files) != 0 {
+		t.Errorf("got %d segment files after close", len(files))
+	}
+	if _, err = os.Stat(dir); err != nil {
+		t.Error(err)
+	}
+}
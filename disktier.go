@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/disk"
+	"github.com/hollowdjj/course-selecting-sys/cache/lru"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//max evicted entries waiting to be written to disk, more are dropped
+const diskQueueSize = 1024
+
+//second tier of mainCache on local disk. entries evicted from mainCache are
+//queued and written by a background goroutine, so eviction never waits for
+//disk. values are kept with their metadata as in arena, see encodeArenaValue
+type diskTier struct {
+	c *disk.Cache
+
+	//evicted entries not yet written, by key
+	pendMu  sync.Mutex
+	pending map[string]lru.Item[string, Value]
+	queue   chan string
+
+	//orders writes of queued entries with deletes, so that a deleted key is
+	//never written back by an eviction queued before the delete
+	ioMu sync.Mutex
+
+	stop    chan struct{}
+	closed  bool //guarded by pendMu
+	wg      sync.WaitGroup
+	dropped int64 //evicted entries dropped for a full queue, accessed atomically
+}
+
+func newDiskTier(c *disk.Cache) *diskTier {
+	d := &diskTier{
+		c:       c,
+		pending: make(map[string]lru.Item[string, Value]),
+		queue:   make(chan string, diskQueueSize),
+		stop:    make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.run()
+	return d
+}
+
+//write queued entries until stopped
+func (d *diskTier) run() {
+	defer d.wg.Done()
+	for {
+		select {
+		case key := <-d.queue:
+			d.write(key)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+//write the pending entry of key if it is still pending
+func (d *diskTier) write(key string) {
+	d.ioMu.Lock()
+	defer d.ioMu.Unlock()
+	d.pendMu.Lock()
+	item, ok := d.pending[key]
+	delete(d.pending, key)
+	d.pendMu.Unlock()
+	if !ok {
+		return
+	}
+	if err := d.c.Put(key, encodeArenaValue(item.Val), item.ExpireAt); err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"key": key,
+			"err": err,
+		}).Errorln("write disk cache failed")
+	}
+}
+
+//queue an entry evicted from mainCache, called with its shard locked
+func (d *diskTier) evicted(item lru.Item[string, Value]) {
+	if item.Val.Len() == 0 || !item.ExpireAt.After(time.Now()) {
+		return
+	}
+	d.pendMu.Lock()
+	defer d.pendMu.Unlock()
+	d.pending[item.Key] = item
+	select {
+	case d.queue <- item.Key:
+	default:
+		delete(d.pending, item.Key)
+		atomic.AddInt64(&d.dropped, 1)
+	}
+}
+
+//look up entry, pending ones included
+func (d *diskTier) get(key string) (lru.Item[string, Value], bool) {
+	d.pendMu.Lock()
+	item, ok := d.pending[key]
+	d.pendMu.Unlock()
+	if ok {
+		return item, item.ExpireAt.After(time.Now())
+	}
+	b, expireAt, ok := d.c.Get(key)
+	if !ok {
+		return item, false
+	}
+	return lru.Item[string, Value]{Key: key, Val: decodeArenaValue(b), ExpireAt: expireAt}, true
+}
+
+//delete entry, pending one included
+func (d *diskTier) del(key string) {
+	d.ioMu.Lock()
+	defer d.ioMu.Unlock()
+	d.pendMu.Lock()
+	delete(d.pending, key)
+	d.pendMu.Unlock()
+	d.c.Del(key)
+}
+
+//stop writing and remove segment files, nothing happens if already closed
+func (d *diskTier) close() {
+	d.pendMu.Lock()
+	if d.closed {
+		d.pendMu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.stop)
+	d.pendMu.Unlock()
+	d.wg.Wait()
+	d.c.Close()
+}
+
+//statistics of disk tier
+func (d *diskTier) stats() CacheStats {
+	s := d.c.Stats()
+	return CacheStats{
+		Items:     s.Items,
+		Bytes:     s.Bytes,
+		MaxBytes:  s.MaxBytes,
+		Gets:      s.Gets,
+		Hits:      s.Hits,
+		Evictions: s.Evictions,
+	}
+}
+
+//keep entries evicted from mainCache in segment files under dir, with at most
+//maxBytes on disk. a miss of mainCache and hotCache is looked up on disk before
+//peers and Getter, and a disk hit is moved back into mainCache with its
+//remaining TTL. entries are written as stored, so encrypted values stay
+//encrypted on disk, and verified against their checksums when read back.
+//dir should be used by this group only, segment files in it are removed now
+//and on Close. call it before use
+func (g *GroupCache) EnableDiskTier(dir string, maxBytes int64) error {
+	c, err := disk.Open(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+	g.disk = newDiskTier(c)
+	g.mainCache.setOnEvict(g.disk.evicted)
+	return nil
+}
+
+//look up disk tier and move a hit back into mainCache
+func (g *GroupCache) lookupDisk(key string) (Value, bool) {
+	if g.disk == nil {
+		return Value{}, false
+	}
+	item, ok := g.disk.get(key)
+	if !ok {
+		return Value{}, false
+	}
+	if !verify(&item.Val) {
+		g.corrupted(key, "disk")
+		g.disk.del(key)
+		return Value{}, false
+	}
+	//a value written meanwhile is newer than the one on disk
+	if _, ok := g.mainCache.cas(key, item.Val, time.Until(item.ExpireAt), 0); !ok {
+		return g.mainCache.get(key)
+	}
+	inc(&g.stats.diskHits)
+	g.checkOverflow()
+	return item.Val, true
+}
+
+//drop the disk copy of key, called whenever mainCache gets a new value of key
+//or loses it, so that an older value never comes back from disk. it is called
+//after mainCache is changed, an old value evicted to disk in between would be
+//kept otherwise
+func (g *GroupCache) dropFromDisk(key string) {
+	if g.disk != nil {
+		g.disk.del(key)
+	}
+}
@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//provides AES keys of 16, 24 or 32 bytes for encryption at rest, see
+//GroupCache.SetEncryption. implementations must be concurrency safe
+type KeyProvider interface {
+	//key new values are encrypted with, and its id
+	CurrentKey() (id string, key []byte, err error)
+
+	//key of id, values encrypted before a rotation are decrypted with it
+	Key(id string) ([]byte, error)
+}
+
+//max length of a key id
+const maxKeyIDLen = 255
+
+//no key is known for the id an entry was encrypted with
+var ErrUnknownKey = errors.New("dcache: unknown encryption key")
+
+//a KeyProvider keeping keys in memory. Rotate switches to a new key while old
+//keys keep decrypting entries already in cache. concurrency safe
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+//create a KeyRing whose current key is key
+func NewKeyRing(id string, key []byte) *KeyRing {
+	k := &KeyRing{}
+	k.Rotate(id, key)
+	return k
+}
+
+//make key the current key. old keys are kept until Forget
+func (k *KeyRing) Rotate(id string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys == nil {
+		k.keys = make(map[string][]byte)
+	}
+	k.keys[id] = copyByteSlice(key)
+	k.current = id
+}
+
+//drop an old key, entries encrypted with it can no longer be read. the current
+//key can not be forgotten
+func (k *KeyRing) Forget(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id != k.current {
+		delete(k.keys, id)
+	}
+}
+
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.keys[k.current]; ok {
+		return k.current, key, nil
+	}
+	return "", nil, ErrUnknownKey
+}
+
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+//AES-GCM over keys of a KeyProvider. a stored value is nonce | ciphertext,
+//sealed with the cache key as additional data so that it can not be moved to
+//another key. the id of the key is kept in Value
+type encryptor struct {
+	keys KeyProvider
+
+	mu    sync.Mutex
+	aeads map[string]keyedAEAD //by key id
+}
+
+//AEAD with the fingerprint of the key it was created with, so that a key id
+//given another key is never served a stale AEAD
+type keyedAEAD struct {
+	fingerprint [sha256.Size]byte
+	a           cipher.AEAD
+}
+
+//AEAD of key id, created on first use and again whenever the key of id changes
+func (e *encryptor) aead(id string, key []byte) (cipher.AEAD, error) {
+	fingerprint := sha256.Sum256(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if k, ok := e.aeads[id]; ok && k.fingerprint == fingerprint {
+		return k.a, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if e.aeads == nil {
+		e.aeads = make(map[string]keyedAEAD)
+	}
+	e.aeads[id] = keyedAEAD{fingerprint: fingerprint, a: a}
+	return a, nil
+}
+
+//encrypt val with the current key
+func (e *encryptor) seal(key string, val Value) (Value, error) {
+	id, k, err := e.keys.CurrentKey()
+	if err != nil {
+		return Value{}, err
+	}
+	//an empty id stands for plaintext
+	if id == "" || len(id) > maxKeyIDLen {
+		return Value{}, fmt.Errorf("key id [%v] must be 1 to %d bytes", id, maxKeyIDLen)
+	}
+	a, err := e.aead(id, k)
+	if err != nil {
+		return Value{}, err
+	}
+	b := make([]byte, a.NonceSize(), a.NonceSize()+val.Len()+a.Overhead())
+	if _, err = rand.Read(b); err != nil {
+		return Value{}, err
+	}
+	b = a.Seal(b, b, val.bytes(), []byte(key))
+	return Value{b: b, codec: val.codec, keyID: id, version: val.version}, nil
+}
+
+//decrypt val encrypted by seal
+func (e *encryptor) open(key string, val Value) (Value, error) {
+	k, err := e.keys.Key(val.keyID)
+	if err != nil {
+		return Value{}, err
+	}
+	a, err := e.aead(val.keyID, k)
+	if err != nil {
+		return Value{}, err
+	}
+	b := val.bytes()
+	if len(b) < a.NonceSize() {
+		return Value{}, fmt.Errorf("encrypted value of %d bytes too short", len(b))
+	}
+	b, err = a.Open(nil, b[:a.NonceSize()], b[a.NonceSize():], []byte(key))
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{b: b, codec: val.codec, version: val.version}, nil
+}
+
+//encrypt values with AES-GCM before they are stored in mainCache and hotCache,
+//keys come from p. the id of the key is kept with every entry, so rotating
+//keys in p does not invalidate cache as long as old keys are still provided.
+//Get returns values decrypted, peers get values decrypted as well. decrypted
+//objects are never kept in plaintext: the object tier of a TypedGroup is
+//refused and stops serving while encryption is set. nil turns encryption off
+//for new values. concurrency safe
+func (g *GroupCache) SetEncryption(p KeyProvider) {
+	if p == nil {
+		g.encryptor.Store(nil)
+		return
+	}
+	g.encryptor.Store(&encryptor{keys: p})
+}
@@ -1,8 +1,12 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hollowdjj/course-selecting-sys/cache/pb"
@@ -31,15 +35,19 @@ type Option struct {
 	FromLocal  bool
 	FromPeer   bool
 	FromGetter bool
-	TTL        time.Duration //unit: second
+	TTL        time.Duration
 }
 
+//ttl of values loaded by DefaultOption and of values loaded to serve peers.
+//it is a time.Duration, a bare 300 would be 300ns and expire at once
+const DefaultTTL = 300 * time.Second
+
 var (
 	rw      sync.RWMutex
 	groups  = make(map[string]*GroupCache)
 	runMode string
 
-	DefaultOption = Option{true, true, true, 300}
+	DefaultOption = Option{true, true, true, DefaultTTL}
 )
 
 //GroupCache stores cache that can be put in the same gruop, eg: student,course
@@ -47,18 +55,57 @@ type GroupCache struct {
 	//group name
 	name string
 
-	//max bytes a GroupCache can hold
+	//max bytes a GroupCache can hold, <= 0 means no limit. accessed atomically
+	//since the memory manager may resize a running GroupCache
 	maxBytes int64
 
+	//share of process memory budget relative to other groups, see SetWeight
+	weight int64
+
+	//separate budgets of mainCache and hotCache set by SetCacheBudgets, each
+	//tier evicts on its own. false means both share maxBytes
+	tiered atomic.Bool
+
+	//hotCache keeps nothing, hot budget set to 0 by SetCacheBudgets
+	hotDisabled atomic.Bool
+
+	//serializes changes of maxBytes and budgets of the tiers, which read and
+	//write several of them. readers use atomics and need no lock
+	budgetMu sync.Mutex
+
 	//getter, passed from user
 	getter Getter
 
 	//通过一致性哈希计算后，落在本节点的缓存
-	mainCache cache
+	mainCache *cache
 
 	//一致性哈希后不应由本节点保存的缓存，但本节点又经常收到相关请求。
 	//为了避免网络开销，保存一个副本。
-	hotCache cache
+	hotCache *cache
+
+	//mainCache之下的磁盘缓存，存放被mainCache驱逐的缓存。nil表示未开启
+	disk *diskTier
+
+	//写回数据源，nil表示只读
+	setter  Setter
+	deleter Deleter
+
+	//异步写回队列，nil表示同步写回(write-through)
+	writeBehind *writeBehind
+
+	//最近分配的版本号，以创建时的纳秒时间戳起始，重启后也不会变小。原子访问
+	version uint64
+
+	//每个Set、Delete和Del都会递增key对应的序号，加载期间序号变化的值不写入缓存
+	writeSeqs [writeSeqs]uint64
+
+	//缓存缺失的key的lease，见GetWithLease。leasing在首次授予lease后置1，原子访问
+	leaseMu      sync.Mutex
+	leases       map[string]*lease
+	leaseTTL     time.Duration
+	staleTTL     time.Duration
+	leaseSweepAt int
+	leasing      uint32
 
 	//分布式节点集
 	peers PeerPicker
@@ -71,6 +118,41 @@ type GroupCache struct {
 
 	//布隆过滤器，防止缓存穿透
 	bloom *bloom.BloomFilter
+
+	//hotCache准入策略，存放*Admission，nil表示全部准入
+	admission atomic.Pointer[Admission]
+
+	//统计数据
+	stats groupStats
+
+	//value压缩配置，nil表示不压缩。存储时读取，整体替换而不加锁
+	compression atomic.Pointer[compressConfig]
+
+	//本地读取时是否校验checksum
+	verifyOnRead atomic.Bool
+
+	//value加密，nil表示不加密。存储及读取时读取，整体替换而不加锁
+	encryptor atomic.Pointer[encryptor]
+
+	//热点key检测及复制的配置，nil表示未开启。每次Get都会读取，
+	//因此整体替换而不加锁，替换时持有hotMu
+	hot atomic.Pointer[hotConfig]
+
+	//key的推送记录(*pushRecord)，无锁判断是否需要推送，
+	//以及写入后是否需要重新推送给持有副本的节点
+	pushed sync.Map
+
+	//保护以下字段
+	hotMu   sync.Mutex
+	hotStop chan struct{}  //停止计数衰减
+	hotWg   sync.WaitGroup //计数衰减及异步推送的goroutine
+	closed  bool
+
+	//定期快照，snapPath为空表示未开启
+	snapMu   sync.Mutex
+	snapPath string
+	snapStop chan struct{}
+	snapWg   sync.WaitGroup
 }
 
 //注册peerpicker
@@ -84,13 +166,68 @@ func (g *GroupCache) EnableBloomFilter(n uint, fp float64) {
 	g.enableBloomFilter = true
 }
 
+//enable idle-timeout mode: a cache lives as long as it keeps being read, each
+//hit pushes its expiry forward by the ttl it was added with. maxLifetime bounds
+//the total lifetime counting from add, zero means no limit
+func (g *GroupCache) EnableSlidingExpiration(maxLifetime time.Duration) {
+	g.mainCache.setSliding(maxLifetime)
+	g.hotCache.setSliding(maxLifetime)
+}
+
+//set admission filter of hotCache, values loaded from peers are only written
+//to hotCache if admitted. every Get of a key owned by a peer asks it, so
+//concurrent Gets sharing one load count one by one. nil admits every value.
+//concurrency safe
+func (g *GroupCache) SetHotCacheAdmission(a Admission) {
+	if a == nil {
+		g.admission.Store(nil)
+		return
+	}
+	g.admission.Store(&a)
+}
+
+//compress values of at least threshold bytes with c before they are stored.
+//memory usage counts compressed size, and compressed values are passed
+//between peers as they are. Get always returns values decompressed.
+//CompressionNone by default. concurrency safe
+func (g *GroupCache) SetCompression(c Compression, threshold int) {
+	g.compression.Store(&compressConfig{codec: c, threshold: threshold})
+}
+
+//select eviction policy of mainCache and hotCache, default is PolicyLRU.
+//cache already in GroupCache is dropped, so call it before use
+func (g *GroupCache) SetEvictionPolicy(p EvictionPolicy) {
+	g.mainCache.setPolicy(p)
+	g.hotCache.setPolicy(p)
+}
+
 //get cache from GroupCache according to the key. Value might be empty according
 //to cache query option
 func (g *GroupCache) Get(key string, opt Option) (Value, error) {
+	val, err := g.get(key, opt)
+	if err == nil {
+		val, err = g.open(key, val)
+	}
+	if err != nil {
+		return Value{}, err
+	}
+	return decompressValue(val)
+}
+
+//same as Get, but return value as stored in cache, which may be compressed
+func (g *GroupCache) get(key string, opt Option) (Value, error) {
+	val, _, err := g.getOrStream(key, opt, false)
+	return val, err
+}
+
+//see get. if stream is true, a value owned by a peer implementing StreamPeer
+//is returned as a reader of the stream instead
+func (g *GroupCache) getOrStream(key string, opt Option, stream bool) (Value, io.ReadCloser, error) {
+	inc(&g.stats.gets)
 	if key == "" {
 		msg := "key requied inorder to get cache"
-		logger.GetInstance().Errorln("msg")
-		return Value{}, fmt.Errorf(msg)
+		logger.GetInstance().Errorln(msg)
+		return Value{}, nil, errors.New(msg)
 	}
 
 	logger.GetInstance().WithFields(logrus.Fields{
@@ -105,88 +242,346 @@ func (g *GroupCache) Get(key string, opt Option) (Value, error) {
 			"group": g.name,
 			"key":   key,
 		}).Infoln("key filtered by bloom filter")
-		return Value{}, fmt.Errorf("key [%v] filtered by bloom filter", key)
+		return Value{}, nil, fmt.Errorf("key [%v] filtered by bloom filter", key)
+	}
+
+	//record access for hot key detection
+	var count uint64
+	hot := g.hot.Load()
+	if hot != nil {
+		count = hot.keys.Add(key)
 	}
 
 	//look up in local cache first
 	if opt.FromLocal {
 		if val, hit := g.lookupLocalCache(key); hit {
+			inc(&g.stats.localHits)
 			logger.GetInstance().WithFields(logrus.Fields{
 				"group": g.name,
 				"key":   key,
 			}).Infoln("get cache from local cache succ")
-			return val, nil
+			g.replicate(hot, key, count)
+			return val, nil, nil
+		}
+		if val, hit := g.lookupDisk(key); hit {
+			logger.GetInstance().WithFields(logrus.Fields{
+				"group": g.name,
+				"key":   key,
+			}).Infoln("get cache from disk succ")
+			g.replicate(hot, key, count)
+			return val, nil, nil
 		}
 	}
 
 	//if not find in local cache, load cache
 	if !opt.FromPeer && !opt.FromGetter {
-		return Value{}, nil
+		return Value{}, nil, nil
+	}
+	//admission counts requests, not loads shared by them
+	admit := false
+	if opt.FromPeer && g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			admit = g.admitHot(key)
+			if sp, ok := peer.(StreamPeer); ok && stream {
+				rc, err := g.streamFromPeer(sp, peer.Addr(), key, opt.TTL, admit)
+				return Value{}, rc, err
+			}
+		}
 	}
-	val, err := g.loadCache(key, opt)
+	val, err := g.loadCache(key, opt, admit)
 	if err != nil {
-		return Value{}, err
+		return Value{}, nil, err
 	}
-	return val, nil
+	g.replicate(hot, key, count)
+	return val, nil, nil
+}
+
+//same as Get, but return value as a reader, which must be closed. a value
+//missing locally and owned by a peer implementing StreamPeer is handed out as
+//it arrives, chunk by chunk with checksums, so it is never buffered as a whole
+//before read. the chunks are kept and go to hotCache once the stream ends
+//verified. such streams are not shared by concurrent calls like loads are
+func (g *GroupCache) GetReader(key string, opt Option) (io.ReadCloser, error) {
+	val, rc, err := g.getOrStream(key, opt, true)
+	if err != nil || rc != nil {
+		return rc, err
+	}
+	if val, err = g.open(key, val); err == nil {
+		val, err = decompressValue(val)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(val.Reader()), nil
 }
 
 //look up in local cache
 func (g *GroupCache) lookupLocalCache(key string) (Value, bool) {
-	if val, hit := g.mainCache.get(key); hit {
-		return val, true
-	}
-	if val, hit := g.hotCache.get(key); hit {
+	for _, c := range []*cache{g.mainCache, g.hotCache} {
+		val, hit := c.get(key)
+		if !hit {
+			continue
+		}
+		if g.verifyOnRead.Load() && !verify(&val) {
+			g.corrupted(key, "local")
+			c.del(key)
+			continue
+		}
 		return val, true
 	}
 	return Value{}, false
 }
 
-//get cache from a peer or Getter
-func (g *GroupCache) loadCache(key string, opt Option) (Value, error) {
-	fromPeer := false
-	val, err := g.shot.Do(key, func() (val interface{}, err error) {
+//value loaded by loadCache and whether it comes from a peer
+type loaded struct {
+	val      Value
+	fromPeer bool
+}
+
+//get cache from a peer or Getter. concurrent loads of the same key share one
+//call, and only that call writes mainCache. a value from a peer goes to
+//hotCache if admit, which every caller decides for itself
+func (g *GroupCache) loadCache(key string, opt Option, admit bool) (Value, error) {
+	val, err := g.shot.Do(key, func() (interface{}, error) {
 		//get from peer
 		if opt.FromPeer && g.peers != nil {
 			if peer, ok := g.peers.PickPeer(key); ok {
-				fromPeer = true
-				return g.getFromPeer(peer, key)
+				res, err := g.getFromPeer(peer, key)
+				if err != nil {
+					return nil, err
+				}
+				inc(&g.stats.peerLoads)
+				return loaded{val: res, fromPeer: true}, nil
 			}
 		}
 		//get from Getter
 		if opt.FromGetter {
-			return g.getFromGetter(key)
+			seq := atomic.LoadUint64(g.writeSeq(key))
+			before, _ := g.mainCache.peek(key)
+			res, err := g.getFromGetter(key)
+			if err != nil {
+				return nil, err
+			}
+			inc(&g.stats.getterLoads)
+			if res.Len() == 0 {
+				return loaded{val: res}, nil
+			}
+			res.version = g.nextVersion()
+			stored, err := g.store(key, res)
+			if err != nil {
+				return loaded{val: res}, nil
+			}
+			//a write happened while loading, what was loaded may be older.
+			//it is not cached, so it has no version
+			if atomic.LoadUint64(g.writeSeq(key)) != seq {
+				stored.version = 0
+				return loaded{val: stored}, nil
+			}
+			//only replace what was cached when the load started, a value
+			//written meanwhile is newer and returned instead
+			version, ok := g.mainCache.cas(key, stored, opt.TTL, before.Val.version)
+			if !ok {
+				if cur, hit := g.mainCache.peek(key); hit {
+					return loaded{val: cur.Val}, nil
+				}
+				stored.version = 0
+				return loaded{val: stored}, nil
+			}
+			stored.version = version
+			g.dropFromDisk(key)
+			g.checkOverflow()
+			return loaded{val: stored}, nil
 		}
-		return
+		return loaded{}, nil
 	})
 
 	if err != nil {
+		inc(&g.stats.loadErrors)
 		logger.GetInstance().WithField("err", err).Errorln("fail to load cache")
 		return Value{}, err
 	}
+	res := val.(loaded)
+	if res.fromPeer && admit {
+		g.populateHotCache(key, res.val, opt.TTL)
+	}
+	return res.val, nil
+}
 
-	//write cache to hotCache if from peer, else write to mainCache
-	res := val.(Value)
-	if len(res.ByteSlice()) != 0 {
-		if fromPeer {
-			g.hotCache.add(key, res, opt.TTL)
-		} else {
-			g.mainCache.add(key, res, opt.TTL)
-		}
+//ask admission filter whether a value of key loaded from peer goes to
+//hotCache, called once for every request
+func (g *GroupCache) admitHot(key string) bool {
+	if g.hotDisabled.Load() {
+		return false
+	}
+	if a := g.admission.Load(); a != nil && !(*a).Admit(key) {
+		inc(&g.stats.hotRejected)
+		return false
+	}
+	inc(&g.stats.hotAdmitted)
+	return true
+}
+
+//write a value loaded from peer to hotCache
+func (g *GroupCache) populateHotCache(key string, val Value, ttl time.Duration) {
+	if val.Len() == 0 {
+		return
+	}
+	if val, err := g.store(key, val); err == nil {
+		g.hotCache.add(key, val, ttl)
+		g.checkOverflow()
 	}
+}
 
-	//check overflow
-	for g.mainCache.nbytes+g.hotCache.nbytes > g.maxBytes {
-		g.hotCache.removeLeastUsed()
+//prepare a value for cache: compress, encrypt and compute checksum of what is
+//stored. the error is logged
+func (g *GroupCache) store(key string, val Value) (Value, error) {
+	if cc := g.compression.Load(); cc != nil {
+		val = compressValue(cc.codec, cc.threshold, val)
+	}
+	if e := g.encryptor.Load(); e != nil && val.keyID == "" {
+		var err error
+		if val, err = e.seal(key, val); err != nil {
+			logger.GetInstance().WithFields(logrus.Fields{
+				"group": g.name,
+				"key":   key,
+				"err":   err,
+			}).Errorln("encrypt value failed")
+			return Value{}, err
+		}
 	}
+	return withChecksum(val), nil
+}
 
+//decrypt a value from cache if it is encrypted, compression is kept
+func (g *GroupCache) open(key string, val Value) (Value, error) {
+	if val.keyID == "" {
+		return val, nil
+	}
+	e := g.encryptor.Load()
+	if e == nil {
+		return Value{}, fmt.Errorf("value encrypted with key [%v] but encryption is off", val.keyID)
+	}
+	res, err := e.open(key, val)
+	if err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   key,
+			"keyID": val.keyID,
+			"err":   err,
+		}).Errorln("decrypt value failed")
+		return Value{}, err
+	}
 	return res, nil
 }
 
+//evict cache until memory usage fits into maxBytes. hotCache is evicted first,
+//then mainCache once hotCache is empty. maxBytes <= 0 means no limit. with
+//separate budgets every tier is kept within its own budget by its shards
+func (g *GroupCache) checkOverflow() {
+	maxBytes := atomic.LoadInt64(&g.maxBytes)
+	if maxBytes <= 0 || g.tiered.Load() {
+		return
+	}
+	for g.mainCache.bytes()+g.hotCache.bytes() > maxBytes {
+		if _, ok := g.hotCache.removeLeastUsed(); ok {
+			continue
+		}
+		if _, ok := g.mainCache.removeLeastUsed(); !ok {
+			return
+		}
+	}
+}
+
+//give mainCache and hotCache separate byte budgets, so that replicas of keys
+//owned by other peers never evict keys this node is authoritative for. each
+//tier evicts by its own eviction policy once its budget is exceeded.
+//mainBytes <= 0 means no limit, hotBytes <= 0 disables hotCache
+func (g *GroupCache) SetCacheBudgets(mainBytes, hotBytes int64) {
+	g.budgetMu.Lock()
+	defer g.budgetMu.Unlock()
+	g.setCacheBudgets(mainBytes, hotBytes)
+}
+
+//see SetCacheBudgets, budgetMu must be held
+func (g *GroupCache) setCacheBudgets(mainBytes, hotBytes int64) {
+	g.tiered.Store(true)
+	g.hotDisabled.Store(hotBytes <= 0)
+	var total int64
+	if mainBytes > 0 {
+		total = mainBytes
+		if hotBytes > 0 {
+			total += hotBytes
+		}
+	}
+	atomic.StoreInt64(&g.maxBytes, total)
+	g.mainCache.setMaxBytes(mainBytes)
+	if hotBytes <= 0 {
+		g.hotCache.setMaxBytes(0)
+		g.hotCache.clear()
+		return
+	}
+	g.hotCache.setMaxBytes(hotBytes)
+}
+
+//split maxBytes between the tiers: hotCache gets ratio of it and mainCache
+//the rest, see SetCacheBudgets. ratio must be in [0, 1), mainCache always
+//keeps a share. nothing happens if ratio is out of range or maxBytes <= 0
+func (g *GroupCache) SetHotCacheRatio(ratio float64) {
+	g.budgetMu.Lock()
+	defer g.budgetMu.Unlock()
+	total := atomic.LoadInt64(&g.maxBytes)
+	if total <= 0 {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"ratio": ratio,
+		}).Warnln("hot cache ratio ignored since max bytes is not limited")
+		return
+	}
+	if ratio < 0 || ratio >= 1 {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"ratio": ratio,
+		}).Warnln("hot cache ratio ignored since it is not in [0, 1)")
+		return
+	}
+	hot := int64(float64(total) * ratio)
+	if hot >= total {
+		//keep mainCache limited, a zero budget means no limit
+		hot = total - 1
+	}
+	g.setCacheBudgets(total-hot, hot)
+}
+
+//set bytes counted for each cache entry besides its key and value, which
+//stands for memory taken by bookkeeping. default is DefaultEntryOverhead
+func (g *GroupCache) SetEntryOverhead(overhead int64) {
+	g.mainCache.setOverhead(overhead)
+	g.hotCache.setOverhead(overhead)
+	g.checkOverflow()
+}
+
+//return memory usage of GroupCache, counted as key + value + overhead of
+//every entry in mainCache and hotCache
+func (g *GroupCache) Bytes() int64 {
+	return g.mainCache.bytes() + g.hotCache.bytes()
+}
+
 //get cache from peer
 func (g *GroupCache) getFromPeer(peer Peer, key string) (Value, error) {
 	req := &pb.GetRequest{Group: g.name, Key: key}
-	resp := &pb.GetResponse{}
-	err := peer.Get(req, resp)
+	var val Value
+	var err error
+	if sp, ok := peer.(StreamPeer); ok {
+		val, err = getStream(sp, req)
+	} else {
+		resp := &pb.GetResponse{}
+		err = peer.Get(req, resp)
+		val = valueOf(resp)
+	}
+	if err == nil && !verifyPeer(&val) {
+		g.corrupted(key, peer.Addr())
+		err = ErrChecksum
+	}
 	if err != nil {
 		logger.GetInstance().WithFields(logrus.Fields{
 			"group": g.name,
@@ -202,11 +597,44 @@ func (g *GroupCache) getFromPeer(peer Peer, key string) (Value, error) {
 		"peer":  peer.Addr(),
 	}).Infoln("get cache from peer succ")
 
-	return Value{b: resp.GetValue()}, nil
+	return val, nil
+}
+
+//get value from a peer by streaming
+func getStream(peer StreamPeer, req *pb.GetRequest) (Value, error) {
+	resp := &pb.GetResponse{}
+	rc, err := peer.GetStream(req, resp)
+	if err != nil {
+		return Value{}, err
+	}
+	defer rc.Close()
+	val, err := readValue(rc)
+	resp.Value = nil
+	meta := valueOf(resp)
+	val.codec, val.sum, val.summed, val.version = meta.codec, meta.sum, meta.summed, meta.version
+	return val, err
+}
+
+//value in a GetResponse with its metadata
+func valueOf(resp *pb.GetResponse) Value {
+	return Value{
+		b:       resp.GetValue(),
+		codec:   Compression(resp.GetCompression()),
+		sum:     resp.GetChecksum(),
+		summed:  resp.Checksum != nil,
+		version: resp.GetVersion(),
+	}
 }
 
 //get from Getter
 func (g *GroupCache) getFromGetter(key string) (Value, error) {
+	//a queued write is newer than what Getter has
+	if op, ok := g.pendingWrite(key); ok {
+		if op.Del {
+			return Value{}, ErrDeleted
+		}
+		return chunkedValue(op.Val), nil
+	}
 	if g.getter == nil {
 		return Value{}, nil
 	}
@@ -224,34 +652,65 @@ func (g *GroupCache) getFromGetter(key string) (Value, error) {
 		"group": g.name,
 		"key":   key,
 	}).Infoln("get cache from getter succ")
-	return Value{b: bytes}, nil
+	return chunkedValue(bytes), nil
 }
 
-//Add cache, if key already exist, its value will be update to data
+//Add cache, if key already exist, its value will be update to data.
+//cache chosen by eviction policy is evicted if maxBytes is exceeded.
+//the lease of key is voided, see GetWithLease
 func (g *GroupCache) Add(key string, data []byte, ttl time.Duration) {
-	g.mainCache.add(key, Value{data}, ttl)
+	g.voidLease(key, Value{}, false)
+	g.voidLeaseOnOwner(key)
+	if val, err := g.store(key, Value{b: data, version: g.nextVersion()}); err == nil {
+		g.mainCache.addVersioned(key, val, ttl)
+	}
+	g.dropFromDisk(key)
+	g.checkOverflow()
 }
 
-//Del cache,if key is not exist nothing will happen
+//Del cache,if key is not exist nothing will happen. the lease of key is
+//voided, see GetWithLease
 func (g *GroupCache) Del(key string) {
+	//a load under way must not bring key back
+	atomic.AddUint64(g.writeSeq(key), 1)
+	item, _ := g.mainCache.peek(key)
+	g.voidLease(key, item.Val, true)
+	g.voidLeaseOnOwner(key)
 	g.mainCache.del(key)
 	g.hotCache.del(key)
+	g.dropFromDisk(key)
 }
 
 //get a new group cache instance, concurrency safe
 func NewGroupCache(name string, maxBytes int64, getter Getter) *GroupCache {
 	res := &GroupCache{
-		name:     name,
-		maxBytes: maxBytes,
-		getter:   getter,
-		shot:     &singleshot.Shots{},
+		name:      name,
+		maxBytes:  maxBytes,
+		getter:    getter,
+		mainCache: newCache(DefaultShards),
+		hotCache:  newCache(DefaultShards),
+		shot:      &singleshot.Shots{},
+		weight:    1,
+		version:   uint64(time.Now().UnixNano()),
+		leaseTTL:  DefaultLeaseTTL,
+		staleTTL:  DefaultStaleTTL,
 	}
 	rw.Lock()
-	defer rw.Unlock()
 	if ret, hit := groups[name]; hit {
+		rw.Unlock()
 		return ret
 	}
+	res.mainCache.setMaxBytes(maxBytes)
+	res.hotCache.setMaxBytes(maxBytes)
+	//replicas share the budget of mainCache, see checkOverflow
+	res.hotCache.setCapacity(0)
+	res.mainCache.timingDel()
+	res.hotCache.timingDel()
 	groups[name] = res
+	rw.Unlock()
+
+	//draw from process memory budget if there is one
+	manager.groupAdded()
 	return res
 }
 
@@ -262,3 +721,35 @@ func GetGroupCache(name string) *GroupCache {
 	g := groups[name]
 	return g
 }
+
+//unregister the group cache, wait for in-flight loads to finish, stop background
+//goroutines, take the final snapshot if enabled, flush queued writes and drop
+//all cache. Get on a closed group cache only returns error.
+//a new group cache with the same name can be created afterwards
+func (g *GroupCache) Close() {
+	rw.Lock()
+	if groups[g.name] == g {
+		delete(groups, g.name)
+	}
+	rw.Unlock()
+
+	g.shot.Close()
+	g.stopHotKeys()
+	g.stopSnapshot()
+	if g.writeBehind != nil {
+		g.writeBehind.close()
+	}
+	g.mainCache.Close()
+	g.hotCache.Close()
+	if g.disk != nil {
+		g.disk.close()
+	}
+}
+
+//close group cache according to group name, nothing happens if not exist.
+//concurrency safe
+func DeleteGroupCache(name string) {
+	if g := GetGroupCache(name); g != nil {
+		g.Close()
+	}
+}
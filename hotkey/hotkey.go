@@ -0,0 +1,131 @@
+package hotkey
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+//一个热点key及其估计的访问次数
+type Item struct {
+	Key   string
+	Count uint64 //估计的访问次数，不小于真实值
+	Err   uint64 //Count的最大高估值，Count-Err不大于真实值
+}
+
+//基于space-saving算法的top-K热点key检测，内存占用固定为k个key。
+//并发安全
+type TopK struct {
+	mu    sync.Mutex
+	k     int
+	items map[string]*counter
+	heap  minHeap //按Count排序的小根堆，堆顶是最冷的key
+}
+
+type counter struct {
+	Item
+	index int //在堆中的位置
+}
+
+//创建一个最多跟踪k个key的TopK实例
+func New(k int) *TopK {
+	if k < 1 {
+		k = 1
+	}
+	return &TopK{k: k, items: make(map[string]*counter, k)}
+}
+
+//记录一次对key的访问，返回key的估计访问次数。
+//key未被跟踪且已跟踪k个key时，替换掉最冷的key，并继承其计数作为误差
+func (t *TopK) Add(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.items[key]; ok {
+		c.Count++
+		heap.Fix(&t.heap, c.index)
+		return c.Count
+	}
+	if len(t.items) < t.k {
+		c := &counter{Item: Item{Key: key, Count: 1}}
+		t.items[key] = c
+		heap.Push(&t.heap, c)
+		return 1
+	}
+	c := t.heap[0]
+	delete(t.items, c.Key)
+	c.Err = c.Count
+	c.Count++
+	c.Key = key
+	t.items[key] = c
+	heap.Fix(&t.heap, 0)
+	return c.Count
+}
+
+//返回key的估计访问次数，未被跟踪时返回0
+func (t *TopK) Count(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.items[key]; ok {
+		return c.Count
+	}
+	return 0
+}
+
+//返回访问次数不小于min的key，按访问次数从高到低排列
+func (t *TopK) List(min uint64) []Item {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res []Item
+	for _, c := range t.items {
+		if c.Count >= min {
+			res = append(res, c.Item)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Count > res[j].Count
+	})
+	return res
+}
+
+//所有计数减半，使检测结果反映近期的访问情况。计数归零的key不再被跟踪
+func (t *TopK) Decay() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, c := range t.items {
+		c.Count >>= 1
+		c.Err >>= 1
+		if c.Count == 0 {
+			heap.Remove(&t.heap, c.index)
+			delete(t.items, key)
+		}
+	}
+	heap.Init(&t.heap)
+}
+
+//按Count排序的小根堆，实现heap.Interface
+type minHeap []*counter
+
+func (h minHeap) Len() int { return len(h) }
+
+func (h minHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h minHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *minHeap) Push(x interface{}) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	last := len(old) - 1
+	c := old[last]
+	old[last] = nil
+	*h = old[:last]
+	return c
+}
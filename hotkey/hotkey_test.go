@@ -0,0 +1,36 @@
+package hotkey
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	topk := New(50)
+
+	//"a"访问100次，"b"访问50次，其余1000个key各访问1次
+	for i := 0; i < 1000; i++ {
+		topk.Add(strconv.Itoa(i))
+		if i%10 == 0 {
+			topk.Add("a")
+		}
+		if i%20 == 0 {
+			topk.Add("b")
+		}
+	}
+
+	//访问次数超过总次数/k的key一定会被跟踪
+	hot := topk.List(0)
+	if len(hot) != 50 || hot[0].Key != "a" || hot[1].Key != "b" {
+		t.Fatalf("got %+v but want a, b", hot)
+	}
+	//space-saving的计数不低于真实值，且高估不超过Err
+	if hot[0].Count < 100 || hot[0].Count-hot[0].Err > 100 {
+		t.Errorf("got %+v but real count is 100", hot[0])
+	}
+
+	topk.Decay()
+	if got := topk.Count("a"); got != hot[0].Count/2 {
+		t.Errorf("got %v after decay but want %v", got, hot[0].Count/2)
+	}
+}
@@ -0,0 +1,306 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/hotkey"
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	//default number of hot keys tracked per GroupCache
+	DefaultHotKeys = 100
+
+	//default interval of halving hot key counts
+	DefaultHotKeyDecay = time.Minute
+)
+
+//config of hot key detection and replication, replaced as a whole
+type hotConfig struct {
+	keys *hotkey.TopK
+
+	//keys requested replicateAt times are pushed by owner to hotCache of all
+	//peers, at most once every replicateEvery. 0 means never
+	replicateAt    uint64
+	replicateEvery time.Duration
+}
+
+//enable hot key detection: the k most requested keys of Get are tracked by a
+//space-saving sketch, taking memory of k keys. counts are halved every decay,
+//so that hot keys reflect recent traffic. decay <= 0 means never. calling it
+//again restarts detection
+func (g *GroupCache) EnableHotKeyDetection(k int, decay time.Duration) {
+	g.hotMu.Lock()
+	defer g.hotMu.Unlock()
+	g.enableHotKeyDetection(k, decay)
+}
+
+//see EnableHotKeyDetection, hotMu must be held
+func (g *GroupCache) enableHotKeyDetection(k int, decay time.Duration) {
+	if g.closed {
+		return
+	}
+	if g.hotStop != nil {
+		close(g.hotStop)
+		g.hotStop = nil
+	}
+	var cfg hotConfig
+	if cur := g.hot.Load(); cur != nil {
+		cfg = *cur
+	}
+	topk := hotkey.New(k)
+	cfg.keys = topk
+	g.hot.Store(&cfg)
+	if decay <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	g.hotStop = stop
+	g.hotWg.Add(1)
+	go func() {
+		defer g.hotWg.Done()
+		ticker := time.NewTicker(decay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				topk.Decay()
+				g.forgetPushed()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+//return at most n hot keys sorted by estimated count from high to low, n <= 0
+//means all tracked keys. nil if hot key detection is not enabled
+func (g *GroupCache) HotKeys(n int) []hotkey.Item {
+	hot := g.hot.Load()
+	if hot == nil {
+		return nil
+	}
+	res := hot.keys.List(0)
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+//enable hot key replication: once a key owned by this node is requested
+//threshold times, its value is pushed to hotCache of all peers, so that
+//requests for it no longer all land on this node. a key is pushed at most once
+//every interval. peers must be registered by a PeerPicker implementing
+//PeerLister, with Peer implementing Pusher, like HttpPool. hot key detection is
+//enabled with DefaultHotKeys and DefaultHotKeyDecay if not yet
+func (g *GroupCache) EnableHotKeyReplication(threshold uint64, interval time.Duration) {
+	g.hotMu.Lock()
+	defer g.hotMu.Unlock()
+	if g.hot.Load() == nil {
+		g.enableHotKeyDetection(DefaultHotKeys, DefaultHotKeyDecay)
+	}
+	cur := g.hot.Load()
+	if cur == nil {
+		//closed
+		return
+	}
+	cfg := *cur
+	cfg.replicateAt = threshold
+	cfg.replicateEvery = interval
+	g.hot.Store(&cfg)
+}
+
+//push key to all peers asynchronously if it is hot and owned by this node.
+//count is the estimated number of requests for key under hot
+func (g *GroupCache) replicate(hot *hotConfig, key string, count uint64) {
+	if hot == nil || hot.replicateAt == 0 || count < hot.replicateAt || g.peers == nil {
+		return
+	}
+	lister, ok := g.peers.(PeerLister)
+	if !ok {
+		return
+	}
+	//only the owner pushes, and keeps push records
+	if _, remote := g.peers.PickPeer(key); remote {
+		return
+	}
+	//decided without locking, so that Gets of the hottest keys never wait for
+	//each other
+	rec, ok := g.claimPush(key, hot.replicateEvery)
+	if !ok {
+		return
+	}
+	g.pushValue(lister, rec, key)
+}
+
+//push the value of key written on this node again if its replicas pushed
+//before are still alive, so that peers do not serve the old one until it
+//expires
+func (g *GroupCache) repush(key string) {
+	if g.peers == nil {
+		return
+	}
+	lister, ok := g.peers.(PeerLister)
+	if !ok {
+		return
+	}
+	v, ok := g.pushed.Load(key)
+	if !ok {
+		return
+	}
+	rec := v.(*pushRecord)
+	if time.Now().UnixNano() >= atomic.LoadInt64(&rec.until) {
+		return
+	}
+	atomic.StoreInt64(&rec.last, time.Now().UnixNano())
+	g.pushValue(lister, rec, key)
+}
+
+//push the value of key in mainCache to all peers asynchronously, rec records
+//until when replicas live
+func (g *GroupCache) pushValue(lister PeerLister, rec *pushRecord, key string) {
+	item, ok := g.mainCache.peek(key)
+	if !ok {
+		return
+	}
+	//peers get the value decrypted, as for Get
+	val, err := g.open(key, item.Val)
+	if err != nil {
+		return
+	}
+	val = withChecksum(val)
+	ttl := time.Until(item.ExpireAt)
+	if ttl <= 0 {
+		return
+	}
+	for until := item.ExpireAt.UnixNano(); ; {
+		prev := atomic.LoadInt64(&rec.until)
+		if prev >= until || atomic.CompareAndSwapInt64(&rec.until, prev, until) {
+			break
+		}
+	}
+
+	g.hotMu.Lock()
+	defer g.hotMu.Unlock()
+	if g.closed {
+		return
+	}
+
+	req := &pb.PushRequest{
+		Group:       g.name,
+		Key:         key,
+		Value:       val.bytes(),
+		Ttl:         ttl.Milliseconds(),
+		Compression: int32(val.codec),
+		Checksum:    proto.Uint32(val.sum),
+		Version:     val.version,
+	}
+	for _, peer := range lister.AllPeers() {
+		pusher, ok := peer.(Pusher)
+		if !ok {
+			continue
+		}
+		g.hotWg.Add(1)
+		go func(peer Peer, pusher Pusher) {
+			defer g.hotWg.Done()
+			g.push(peer, pusher, req)
+		}(peer, pusher)
+	}
+}
+
+//push a hot key to peer
+func (g *GroupCache) push(peer Peer, pusher Pusher, req *pb.PushRequest) {
+	inc(&g.stats.hotPushes)
+	if err := pusher.Push(req); err != nil {
+		inc(&g.stats.hotPushErrors)
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   req.GetKey(),
+			"peer":  peer.Addr(),
+			"err":   err,
+		}).Errorln("push hot key to peer failed")
+		return
+	}
+	logger.GetInstance().WithFields(logrus.Fields{
+		"group": g.name,
+		"key":   req.GetKey(),
+		"peer":  peer.Addr(),
+	}).Infoln("push hot key to peer succ")
+}
+
+//pushes of a key, fields are accessed atomically
+type pushRecord struct {
+	last  int64 //unix nano of the last push
+	until int64 //unix nano the replicas pushed expire at
+}
+
+//claim the push of key unless it was pushed within every, return false if it
+//was or another Get claimed it first. lock-free
+func (g *GroupCache) claimPush(key string, every time.Duration) (*pushRecord, bool) {
+	v, ok := g.pushed.Load(key)
+	if !ok {
+		v, _ = g.pushed.LoadOrStore(key, &pushRecord{})
+	}
+	rec := v.(*pushRecord)
+	now := time.Now().UnixNano()
+	prev := atomic.LoadInt64(&rec.last)
+	if prev != 0 && now-prev < int64(every) {
+		return rec, false
+	}
+	return rec, atomic.CompareAndSwapInt64(&rec.last, prev, now)
+}
+
+//drop push records older than replicateEvery whose replicas have expired, so
+//that pushed only holds keys recently hot or still replicated
+func (g *GroupCache) forgetPushed() {
+	hot := g.hot.Load()
+	if hot == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	g.pushed.Range(func(key, v interface{}) bool {
+		rec := v.(*pushRecord)
+		if now-atomic.LoadInt64(&rec.last) >= int64(hot.replicateEvery) && now >= atomic.LoadInt64(&rec.until) {
+			g.pushed.Delete(key)
+		}
+		return true
+	})
+}
+
+//write a hot key pushed by its owner to hotCache. admission filter is
+//bypassed since the owner has seen it is hot
+func (g *GroupCache) receivePush(key string, val Value, ttl time.Duration) {
+	if key == "" || val.Len() == 0 || ttl <= 0 || g.hotDisabled.Load() {
+		return
+	}
+	if !verifyPeer(&val) {
+		g.corrupted(key, "push")
+		return
+	}
+	//pushes are sent concurrently, an older one may come last
+	if cur, ok := g.hotCache.peek(key); ok && cur.Val.version > val.version {
+		return
+	}
+	inc(&g.stats.hotReceived)
+	if val, err := g.store(key, val); err == nil {
+		g.hotCache.add(key, val, ttl)
+		g.checkOverflow()
+	}
+}
+
+//stop decay goroutine and wait for in-flight pushes
+func (g *GroupCache) stopHotKeys() {
+	g.hotMu.Lock()
+	g.closed = true
+	if g.hotStop != nil {
+		close(g.hotStop)
+		g.hotStop = nil
+	}
+	g.hotMu.Unlock()
+	g.hotWg.Wait()
+}
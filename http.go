@@ -1,14 +1,42 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hollowdjj/course-selecting-sys/cache/consistent"
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	defaultReplicas = 50
 	defaultRoute    = "/_dcache"
+
+	//routes of CompareAndSet, Incr and leases under defaultRoute
+	casRoute        = "/cas"
+	incrRoute       = "/incr"
+	leaseRoute      = "/lease"
+	leaseSetRoute   = "/leaseset"
+	invalidateRoute = "/invalidate"
+
+	//largest PushRequest, CASRequest and LeaseSetRequest accepted, a bigger
+	//body is refused
+	maxPushBytes = 64 << 20
+
+	//largest IncrRequest, LeaseRequest and InvalidateRequest accepted, they
+	//carry no value
+	maxIncrBytes = 64 << 10
 )
 
 //Http连接池，保存有与哈希环上所有其他节点的http连接
@@ -23,12 +51,27 @@ type HttpPool struct {
 
 	//与所有真实节点的连接
 	peers map[string]Peer
+
+	//所有peer共用的http客户端，Close时关闭空闲连接
+	transport *http.Transport
+	client    *http.Client
+
+	//Close时取消所有进行中的请求
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
 }
 
 //创建一个HttpPool实例。selfAddr eg:127.0.0.1:8000
 func NewHttpPool(selfAddr string) *HttpPool {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	ctx, cancel := context.WithCancel(context.Background())
 	return &HttpPool{
-		selfAddr: selfAddr,
+		selfAddr:  selfAddr,
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+		ctx:       ctx,
+		cancel:    cancel,
 	}
 }
 
@@ -46,7 +89,11 @@ func (h *HttpPool) AddPeers(addrs ...string) []string {
 	}
 
 	for _, addr := range addrs {
-		h.peers[addr] = &httpPeer{remoteBaseUrl: "http://" + addr + defaultRoute}
+		h.peers[addr] = &httpPeer{
+			remoteBaseUrl: "http://" + addr + defaultRoute,
+			client:        h.client,
+			ctx:           h.ctx,
+		}
 	}
 	h.hash.AddNodes(addrs...)
 	var res []string
@@ -80,6 +127,22 @@ func (h *HttpPool) DelPeer(host string) []string {
 	return res
 }
 
+//return all peers except self, concurrency safe. implements PeerLister
+func (h *HttpPool) AllPeers() []Peer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	var res []Peer
+	for addr, peer := range h.peers {
+		if addr != h.selfAddr {
+			res = append(res, peer)
+		}
+	}
+	return res
+}
+
 //设置一致性哈希
 func (h *HttpPool) SetConsistentHash(hash *consistent.ConsistentHash) {
 	h.hash = hash
@@ -91,9 +154,311 @@ func (h *HttpPool) SetConsistentHash(hash *consistent.ConsistentHash) {
 func (h *HttpPool) PickPeer(key string) (Peer, bool) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	if h.closed || h.hash == nil {
+		return nil, false
+	}
 	if node := h.hash.GetNode(key); node != "" && node != h.selfAddr {
 		return h.peers[node], true
 	}
 
 	return nil, false
 }
+
+//关闭HttpPool：取消所有进行中的请求并关闭空闲连接。
+//关闭后PickPeer总是返回nil,false，多次调用是安全的
+func (h *HttpPool) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.transport != nil {
+		h.transport.CloseIdleConnections()
+	}
+}
+
+//处理其他节点的请求。
+//GET ?group=xx&key=xx: 只从本地缓存或Getter获取，避免节点间循环请求。
+//带上stream=1时，大于ChunkThreshold的value以分块流的形式返回；
+//带上raw=1时，压缩过的value原样返回并标明压缩算法
+//POST PushRequest: owner推送的热点key，写入hotCache
+//POST /cas CASRequest: 其他节点转发的CompareAndSet，本机是key的owner
+//POST /incr IncrRequest: 其他节点转发的Incr，本机是key的owner
+//POST /lease LeaseRequest, POST /leaseset LeaseSetRequest: 其他节点转发的
+//GetWithLease和SetWithLease，本机是key的owner
+//POST /invalidate InvalidateRequest: 其他节点写入或删除key，本机作废lease
+func (h *HttpPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, defaultRoute) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.serveGet(w, r)
+	case http.MethodPost:
+		switch {
+		case strings.HasSuffix(r.URL.Path, casRoute):
+			h.serveCAS(w, r)
+		case strings.HasSuffix(r.URL.Path, incrRoute):
+			h.serveIncr(w, r)
+		case strings.HasSuffix(r.URL.Path, leaseRoute):
+			h.serveLease(w, r)
+		case strings.HasSuffix(r.URL.Path, leaseSetRoute):
+			h.serveLeaseSet(w, r)
+		case strings.HasSuffix(r.URL.Path, invalidateRoute):
+			h.serveInvalidate(w, r)
+		default:
+			h.servePush(w, r)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *HttpPool) serveGet(w http.ResponseWriter, r *http.Request) {
+	name, key := r.URL.Query().Get("group"), r.URL.Query().Get("key")
+	g := GetGroupCache(name)
+	if g == nil {
+		http.Error(w, "no such group: "+name, http.StatusNotFound)
+		return
+	}
+	val, err := g.get(key, Option{FromLocal: true, FromGetter: true, TTL: DefaultTTL})
+	if err == nil {
+		//values are encrypted at rest only
+		val, err = g.open(key, val)
+	}
+	if err == nil && r.URL.Query().Get("raw") != "1" {
+		//peer does not understand compression
+		val, err = decompressValue(val)
+	}
+	val = withChecksum(val)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("stream") == "1" {
+		err = writeValue(w, val)
+	} else {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		err = writeGetResponse(w, val)
+	}
+	if err != nil {
+		//status is sent already, the peer sees a truncated response and
+		//rejects it
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": name,
+			"key":   key,
+			"err":   err,
+		}).Warnln("write get response failed")
+	}
+}
+
+//write val as an encoded pb.GetResponse. only the field headers are encoded,
+//value itself goes to w without being copied into a message buffer
+func writeGetResponse(w http.ResponseWriter, val Value) error {
+	if val.Len() == 0 {
+		//empty message
+		w.Header().Set("Content-Length", "0")
+		return nil
+	}
+	//fields may appear in any order, value goes last
+	var header []byte
+	if val.codec != CompressionNone {
+		header = protowire.AppendTag(header, 2, protowire.VarintType)
+		header = protowire.AppendVarint(header, uint64(val.codec))
+	}
+	if val.summed {
+		header = protowire.AppendTag(header, 3, protowire.Fixed32Type)
+		header = protowire.AppendFixed32(header, val.sum)
+	}
+	if val.version != 0 {
+		header = protowire.AppendTag(header, 4, protowire.VarintType)
+		header = protowire.AppendVarint(header, val.version)
+	}
+	header = protowire.AppendTag(header, 1, protowire.BytesType)
+	header = protowire.AppendVarint(header, uint64(val.Len()))
+	w.Header().Set("Content-Length", strconv.Itoa(len(header)+val.Len()))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := val.WriteTo(w)
+	return err
+}
+
+//read body of r, a body larger than limit is refused. the error is written to
+//w and false returned on failure
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+func (h *HttpPool) servePush(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxPushBytes)
+	if !ok {
+		return
+	}
+	req := &pb.PushRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := GetGroupCache(req.GetGroup())
+	if g == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+	val := Value{
+		b:       req.GetValue(),
+		codec:   Compression(req.GetCompression()),
+		sum:     req.GetChecksum(),
+		summed:  req.Checksum != nil,
+		version: req.GetVersion(),
+	}
+	g.receivePush(req.GetKey(), val, time.Duration(req.GetTtl())*time.Millisecond)
+	body, _ = proto.Marshal(&pb.PushResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+func (h *HttpPool) serveCAS(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxPushBytes)
+	if !ok {
+		return
+	}
+	req := &pb.CASRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := GetGroupCache(req.GetGroup())
+	if g == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+	version, err := g.compareAndSetLocal(req.GetKey(), req.GetExpected(), req.GetValue(),
+		time.Duration(req.GetTtl())*time.Millisecond)
+	if err != nil && err != ErrVersionMismatch {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, _ = proto.Marshal(&pb.CASResponse{Ok: err == nil, Version: version})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+func (h *HttpPool) serveIncr(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxIncrBytes)
+	if !ok {
+		return
+	}
+	req := &pb.IncrRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := GetGroupCache(req.GetGroup())
+	if g == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+	n, err := g.incrLocal(req.GetKey(), req.GetDelta(), boundsOf(req),
+		time.Duration(req.GetTtl())*time.Millisecond)
+	if err != nil && err != ErrOutOfBounds {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, _ = proto.Marshal(&pb.IncrResponse{Value: n, OutOfBounds: err == ErrOutOfBounds})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+func (h *HttpPool) serveLease(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxIncrBytes)
+	if !ok {
+		return
+	}
+	req := &pb.LeaseRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := GetGroupCache(req.GetGroup())
+	if g == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+	res, err := g.leaseLocal(req.GetKey())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, _ = proto.Marshal(&pb.LeaseResponse{
+		Value: res.Value.ByteSlice(),
+		Token: res.Token,
+		Wait:  res.Wait,
+		Stale: res.Stale,
+	})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+func (h *HttpPool) serveLeaseSet(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxPushBytes)
+	if !ok {
+		return
+	}
+	req := &pb.LeaseSetRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := GetGroupCache(req.GetGroup())
+	if g == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+	err := g.setWithLeaseLocal(req.GetKey(), req.GetToken(), req.GetValue(),
+		time.Duration(req.GetTtl())*time.Millisecond)
+	if err != nil && err != ErrLeaseInvalid {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, _ = proto.Marshal(&pb.LeaseSetResponse{Ok: err == nil})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
+
+func (h *HttpPool) serveInvalidate(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r, maxIncrBytes)
+	if !ok {
+		return
+	}
+	req := &pb.InvalidateRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := GetGroupCache(req.GetGroup())
+	if g == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+	g.voidLease(req.GetKey(), Value{}, false)
+	body, _ = proto.Marshal(&pb.InvalidateResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(body)
+}
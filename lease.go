@@ -0,0 +1,295 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//how long a lease stays valid if its holder never fills key
+	DefaultLeaseTTL = 10 * time.Second
+
+	//how long the value of a deleted key is still served as stale
+	DefaultStaleTTL = 10 * time.Second
+)
+
+//the lease is void: key was written or deleted after it was granted, it
+//expired, or key was filled meanwhile. what the holder loaded may be stale and
+//is not cached
+var ErrLeaseInvalid = errors.New("dcache: lease invalid")
+
+//result of GetWithLease. it is a hit if neither Token nor Wait is set
+type LeaseResult struct {
+	//value in cache, or the value before key was deleted if Stale
+	Value Value
+
+	//lease granted to the caller, 0 if not granted. the holder loads key and
+	//passes the token to SetWithLease
+	Token uint64
+
+	//another client holds the lease, retry after a short while or use Value
+	//if Stale
+	Wait bool
+
+	//Value is the value before key was deleted
+	Stale bool
+}
+
+//lease of a key missing in cache, see GetWithLease
+type lease struct {
+	token    uint64    //0 means no lease is out
+	expireAt time.Time //lease is void afterwards
+
+	//value as stored before key was deleted, served until staleUntil
+	stale      Value
+	staleUntil time.Time
+}
+
+//set how long a lease stays valid and how long the value of a deleted key is
+//served as stale, DefaultLeaseTTL and DefaultStaleTTL by default. staleTTL <= 0
+//keeps no stale values
+func (g *GroupCache) SetLeaseTTL(leaseTTL, staleTTL time.Duration) {
+	g.leaseMu.Lock()
+	defer g.leaseMu.Unlock()
+	g.leaseTTL = leaseTTL
+	g.staleTTL = staleTTL
+}
+
+//get key from cache, or a lease on it if it is missing. only one client at a
+//time gets the lease of a key, the others are told to wait and given the value
+//before key was deleted if there is one, so that a miss reaches the backing
+//store once however many clients see it. the holder loads key and fills it by
+//SetWithLease, which fails if key was written or deleted in the meantime.
+//leases are kept by the owner of key and requests are forwarded to it through
+//a Peer implementing LeasePeer. Getter is not called. Add, Del, Set, Delete,
+//CompareAndSet and Incr void the lease, on other nodes by telling the owner
+func (g *GroupCache) GetWithLease(key string) (LeaseResult, error) {
+	if key == "" {
+		return LeaseResult{}, errors.New("key requied inorder to get cache")
+	}
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			return g.leaseOnPeer(peer, key)
+		}
+	}
+	return g.leaseLocal(key)
+}
+
+//fill key with data loaded under the lease token, return ErrLeaseInvalid if
+//the lease is void. see GetWithLease
+func (g *GroupCache) SetWithLease(key string, token uint64, data []byte, ttl time.Duration) error {
+	if key == "" {
+		return errors.New("key requied inorder to set cache")
+	}
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			return g.setWithLeaseOnPeer(peer, key, token, data, ttl)
+		}
+	}
+	return g.setWithLeaseLocal(key, token, data, ttl)
+}
+
+//GetWithLease on this node, which owns key. the value is returned decrypted
+//and decompressed
+func (g *GroupCache) leaseLocal(key string) (LeaseResult, error) {
+	for {
+		val, hit := g.lookupLocalCache(key)
+		if !hit {
+			val, hit = g.lookupDisk(key)
+		}
+		var res LeaseResult
+		if hit {
+			res.Value = val
+		} else if res, hit = g.acquireLease(key); hit {
+			//filled after the lookup above
+			continue
+		}
+		if res.Value.Len() == 0 {
+			return res, nil
+		}
+		val, err := g.open(key, res.Value)
+		if err == nil {
+			val, err = decompressValue(val)
+		}
+		res.Value = val
+		return res, err
+	}
+}
+
+//grant the lease of key, or tell the caller to wait if it is out. return
+//false as well if key is in cache by now
+func (g *GroupCache) acquireLease(key string) (LeaseResult, bool) {
+	g.leaseMu.Lock()
+	defer g.leaseMu.Unlock()
+	//leases are filled with the lock held
+	if _, ok := g.mainCache.peek(key); ok {
+		return LeaseResult{}, true
+	}
+	//lazy initialization
+	if g.leases == nil {
+		g.leases = make(map[string]*lease)
+		atomic.StoreUint32(&g.leasing, 1)
+	}
+	now := time.Now()
+	if len(g.leases) >= g.leaseSweepAt {
+		g.sweepLeases(now)
+	}
+	l := g.leases[key]
+	if l == nil {
+		l = &lease{}
+		g.leases[key] = l
+	}
+	var res LeaseResult
+	if now.Before(l.staleUntil) {
+		res.Value, res.Stale = l.stale, true
+	}
+	if l.token != 0 && now.Before(l.expireAt) {
+		inc(&g.stats.leaseWaits)
+		res.Wait = true
+		return res, false
+	}
+	inc(&g.stats.leasesGranted)
+	l.token = g.nextVersion()
+	l.expireAt = now.Add(g.leaseTTL)
+	res.Token = l.token
+	return res, false
+}
+
+//SetWithLease on this node, which owns key
+func (g *GroupCache) setWithLeaseLocal(key string, token uint64, data []byte, ttl time.Duration) error {
+	val, err := g.store(key, Value{b: data, version: g.nextVersion()})
+	if err != nil {
+		return err
+	}
+	g.leaseMu.Lock()
+	l := g.leases[key]
+	ok := token != 0 && l != nil && l.token == token && time.Now().Before(l.expireAt)
+	if ok {
+		//a lease fills a miss only, a value written meanwhile is newer
+		if _, ok = g.mainCache.cas(key, val, ttl, 0); ok {
+			g.dropFromDisk(key)
+		}
+		delete(g.leases, key)
+	}
+	g.leaseMu.Unlock()
+	if !ok {
+		inc(&g.stats.leaseRejects)
+		return ErrLeaseInvalid
+	}
+	g.checkOverflow()
+	return nil
+}
+
+//void the lease of key since key is written or deleted, so that its holder,
+//which may have loaded key before, cannot fill it. stored is the value before
+//a delete, kept to be served as stale
+func (g *GroupCache) voidLease(key string, stored Value, deleted bool) {
+	if atomic.LoadUint32(&g.leasing) == 0 {
+		//no lease was ever granted
+		return
+	}
+	g.leaseMu.Lock()
+	defer g.leaseMu.Unlock()
+	if !deleted || g.staleTTL <= 0 || stored.Len() == 0 {
+		delete(g.leases, key)
+		return
+	}
+	g.leases[key] = &lease{stale: stored, staleUntil: time.Now().Add(g.staleTTL)}
+}
+
+//void the lease of key on its owner if it is another node, since key is
+//written or deleted here. failures are logged, the lease then lasts until it
+//expires
+func (g *GroupCache) voidLeaseOnOwner(key string) {
+	if g.peers == nil {
+		return
+	}
+	peer, ok := g.peers.PickPeer(key)
+	if !ok {
+		return
+	}
+	leasePeer, ok := peer.(LeasePeer)
+	if !ok {
+		return
+	}
+	req := &pb.InvalidateRequest{Group: g.name, Key: key}
+	if err := leasePeer.Invalidate(req, &pb.InvalidateResponse{}); err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   key,
+			"peer":  peer.Addr(),
+			"err":   err,
+		}).Errorln("invalidate lease on peer failed")
+	}
+}
+
+//drop void leases and stale values out of date, leaseMu must be held
+func (g *GroupCache) sweepLeases(now time.Time) {
+	for key, l := range g.leases {
+		if !now.Before(l.expireAt) && !now.Before(l.staleUntil) {
+			delete(g.leases, key)
+		}
+	}
+	g.leaseSweepAt = 2*len(g.leases) + 64
+}
+
+//forward GetWithLease to peer owning key
+func (g *GroupCache) leaseOnPeer(peer Peer, key string) (LeaseResult, error) {
+	leasePeer, ok := peer.(LeasePeer)
+	if !ok {
+		return LeaseResult{}, fmt.Errorf("peer [%v] does not support leases", peer.Addr())
+	}
+	resp := &pb.LeaseResponse{}
+	if err := leasePeer.Lease(&pb.LeaseRequest{Group: g.name, Key: key}, resp); err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   key,
+			"peer":  peer.Addr(),
+			"err":   err,
+		}).Errorln("get lease from peer failed")
+		return LeaseResult{}, fmt.Errorf("get lease from peer [%v] failed: %v", peer.Addr(), err)
+	}
+	return LeaseResult{
+		Value: Value{b: resp.GetValue()},
+		Token: resp.GetToken(),
+		Wait:  resp.GetWait(),
+		Stale: resp.GetStale(),
+	}, nil
+}
+
+//forward SetWithLease to peer owning key
+func (g *GroupCache) setWithLeaseOnPeer(peer Peer, key string, token uint64, data []byte, ttl time.Duration) error {
+	leasePeer, ok := peer.(LeasePeer)
+	if !ok {
+		return fmt.Errorf("peer [%v] does not support leases", peer.Addr())
+	}
+	req := &pb.LeaseSetRequest{
+		Group: g.name,
+		Key:   key,
+		Token: token,
+		Value: data,
+		Ttl:   ttl.Milliseconds(),
+	}
+	resp := &pb.LeaseSetResponse{}
+	if err := leasePeer.LeaseSet(req, resp); err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   key,
+			"peer":  peer.Addr(),
+			"err":   err,
+		}).Errorln("set with lease on peer failed")
+		return fmt.Errorf("set with lease on peer [%v] failed: %v", peer.Addr(), err)
+	}
+	if !resp.GetOk() {
+		return ErrLeaseInvalid
+	}
+	//the replica here is stale now
+	g.hotCache.del(key)
+	return nil
+}
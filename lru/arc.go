@@ -0,0 +1,133 @@
+package lru
+
+import "time"
+
+//ARC (adaptive replacement cache). elements seen once live in t1, elements
+//seen at least twice in t2. keys evicted from t1 and t2 are remembered in
+//ghost lists b1 and b2, and a hit in a ghost list shifts the target size p of
+//t1 towards the side that would have kept the key, so the cache tunes itself
+//between recency and frequency without configuration. capacity is learned
+//from Len every time eviction is needed, as the cache is bounded by bytes.
+//zero value is ready to use, not concurrency safe
+type ARC[K comparable, V any] struct {
+	base[K, V]
+
+	t1, t2 nodeList[K, V]
+	b1, b2 ghostList[K, V]
+
+	p        int //target size of t1
+	capacity int //number of elements when the cache is full
+}
+
+//create a new ARC cache
+func NewARC[K comparable, V any]() *ARC[K, V] {
+	return &ARC[K, V]{}
+}
+
+//add element to cache. if key exists, its value is replaced and the old value
+//is returned with replaced = true. OnDroped is not called for the old value.
+//a key found in a ghost list adapts p and enters t2
+func (a *ARC[K, V]) Add(key K, val V, ttl time.Duration) (old V, replaced bool) {
+	a.lazyInit()
+	now := time.Now()
+	if n, ok := a.items[key]; ok {
+		old = a.update(n, val, ttl, now)
+		a.promote(n)
+		return old, true
+	}
+
+	n := a.newNode(key, val, ttl, now)
+	switch {
+	case a.b1.remove(key):
+		//t1 was too small
+		a.p = minInt(a.p+maxInt(a.b2.len()/maxInt(a.b1.len(), 1), 1), a.capacity)
+		a.t2.pushFront(n)
+	case a.b2.remove(key):
+		//t2 was too small
+		a.p = maxInt(a.p-maxInt(a.b1.len()/maxInt(a.b2.len(), 1), 1), 0)
+		a.t2.pushFront(n)
+	default:
+		a.t1.pushFront(n)
+	}
+	return old, false
+}
+
+//look up cache according to key. expired element is deleted and treated as
+//a miss. in sliding mode, a hit pushes expiration forward
+func (a *ARC[K, V]) Get(key K) (val V, ok bool) {
+	if item, ok := a.GetItem(key); ok {
+		return item.Val, true
+	}
+	return val, false
+}
+
+//same as Get, but return a copy of the element along with its expiration
+func (a *ARC[K, V]) GetItem(key K) (item Item[K, V], ok bool) {
+	n, hit := a.items[key]
+	if !hit || !a.hit(n, time.Now()) {
+		return item, false
+	}
+	a.promote(n)
+	return n.item(), true
+}
+
+//a hit moves n to the front of t2
+func (a *ARC[K, V]) promote(n *node[K, V]) {
+	if n.list == &a.t2 {
+		a.t2.moveToFront(n)
+		return
+	}
+	a.t1.remove(n)
+	a.t2.pushFront(n)
+}
+
+//evict the oldest element of t1 if t1 exceeds p, else of t2. the key is
+//remembered in the ghost list. OnDroped is called as for Del. return false if
+//cache is empty
+func (a *ARC[K, V]) RemoveOldest() (key K, val V, ok bool) {
+	if len(a.items) == 0 {
+		return key, val, false
+	}
+	a.capacity = len(a.items) - 1
+
+	var n *node[K, V]
+	if a.t1.len > 0 && (a.t1.len > a.p || a.t2.len == 0) {
+		n = a.t1.back()
+		a.evict(n)
+		a.b1.push(n.key)
+	} else {
+		n = a.t2.back()
+		a.evict(n)
+		a.b2.push(n.key)
+	}
+
+	//|t1|+|b1| <= c and |t1|+|t2|+|b1|+|b2| <= 2c
+	a.b1.trim(maxInt(a.capacity-a.t1.len, 0))
+	a.b2.trim(maxInt(2*a.capacity-a.t1.len-a.t2.len-a.b1.len(), 0))
+	return n.key, n.val, true
+}
+
+//clear all cache, OnDroped is called for each element. ghost lists and the
+//learned p are dropped as well
+func (a *ARC[K, V]) Clear() {
+	a.clear()
+	a.t1 = nodeList[K, V]{}
+	a.t2 = nodeList[K, V]{}
+	a.b1.clear()
+	a.b2.clear()
+	a.p = 0
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,241 @@
+package lru
+
+import (
+	"container/heap"
+	"time"
+)
+
+//config shared by all caches in this package
+type Config[K comparable, V any] struct {
+	//callback when element is deleted, expired, evicted or cleared
+	OnDroped func(key K, val V)
+
+	//callback when element is evicted by RemoveOldest, after OnDroped. not
+	//called for Del, expiration or Clear
+	OnEvicted func(item Item[K, V])
+
+	//bytes counted for an element, see Bytes. nil means 0
+	Size func(key K, val V) int64
+
+	//sliding expiration: every hit pushes expireAt forward by the ttl passed
+	//to Add, so an element lives as long as it keeps being read
+	Sliding bool
+
+	//absolute max lifetime of an element when Sliding is on, counting from the
+	//moment it is added. zero means no limit
+	MaxLifetime time.Duration
+}
+
+//a copy of an element in cache
+type Item[K comparable, V any] struct {
+	Key      K
+	Val      V
+	ExpireAt time.Time
+}
+
+//hash map, expiry index and byte accounting shared by all caches in this
+//package. eviction order is up to the cache embedding it
+type base[K comparable, V any] struct {
+	Config[K, V]
+
+	items  map[K]*node[K, V]
+	expiry expiryHeap[K, V]
+	bytes  int64
+
+	//unlink a node from eviction order on drop, for caches that do not keep
+	//nodes in a nodeList
+	detach func(n *node[K, V])
+}
+
+//lazy initialization, so that zero value is ready to use
+func (b *base[K, V]) lazyInit() {
+	if b.items == nil {
+		b.items = make(map[K]*node[K, V])
+	}
+}
+
+//replace config. Size is not applied to elements already in cache until
+//Recount
+func (b *base[K, V]) Configure(cfg Config[K, V]) {
+	b.Config = cfg
+}
+
+//create a node and index it, the caller links it into a list
+func (b *base[K, V]) newNode(key K, val V, ttl time.Duration, now time.Time) *node[K, V] {
+	n := &node[K, V]{key: key, val: val}
+	b.resetExpiration(n, ttl, now)
+	n.size = b.sizeOf(key, val)
+	b.items[key] = n
+	heap.Push(&b.expiry, n)
+	b.bytes += n.size
+	return n
+}
+
+//replace value of n, return the old one. OnDroped is not called for it
+func (b *base[K, V]) update(n *node[K, V], val V, ttl time.Duration, now time.Time) V {
+	old := n.val
+	n.val = val
+	b.resetExpiration(n, ttl, now)
+	heap.Fix(&b.expiry, n.index)
+	b.bytes -= n.size
+	n.size = b.sizeOf(n.key, val)
+	b.bytes += n.size
+	return old
+}
+
+//set expiration of a node that is (re)written at the moment now
+func (b *base[K, V]) resetExpiration(n *node[K, V], ttl time.Duration, now time.Time) {
+	n.ttl = ttl
+	n.deadline = time.Time{}
+	if b.Sliding && b.MaxLifetime > 0 {
+		n.deadline = now.Add(b.MaxLifetime)
+	}
+	n.touch(now)
+}
+
+//called on every hit of n. an expired node is dropped and false is returned.
+//in sliding mode expireAt is pushed forward
+func (b *base[K, V]) hit(n *node[K, V], now time.Time) bool {
+	if n.expired(now) {
+		b.drop(n)
+		return false
+	}
+	if b.Sliding {
+		n.touch(now)
+		heap.Fix(&b.expiry, n.index)
+	}
+	return true
+}
+
+//unlink n from its list and all indexes, then call OnDroped
+func (b *base[K, V]) drop(n *node[K, V]) {
+	if b.detach != nil {
+		b.detach(n)
+	} else if n.list != nil {
+		n.list.remove(n)
+	}
+	delete(b.items, n.key)
+	heap.Remove(&b.expiry, n.index)
+	b.bytes -= n.size
+	if b.OnDroped != nil {
+		b.OnDroped(n.key, n.val)
+	}
+}
+
+//drop n evicted by RemoveOldest, then call OnEvicted
+func (b *base[K, V]) evict(n *node[K, V]) {
+	b.drop(n)
+	if b.OnEvicted != nil {
+		b.OnEvicted(n.item())
+	}
+}
+
+//look up cache without updating eviction order or expiration
+func (b *base[K, V]) Peek(key K) (item Item[K, V], ok bool) {
+	n, hit := b.items[key]
+	if !hit || n.expired(time.Now()) {
+		return item, false
+	}
+	return n.item(), true
+}
+
+//call f on a copy of every element not expired, in no particular order, until
+//f returns false. eviction order and expiration are not updated
+func (b *base[K, V]) Range(f func(item Item[K, V]) bool) {
+	now := time.Now()
+	for _, n := range b.items {
+		if !n.expired(now) && !f(n.item()) {
+			return
+		}
+	}
+}
+
+//delete cache according key, return false if not exist
+func (b *base[K, V]) Del(key K) bool {
+	n, hit := b.items[key]
+	if hit {
+		b.drop(n)
+	}
+	return hit
+}
+
+//remove at most limit elements that are expired at the moment now, earliest
+//expired first. return number of elements removed. work done is proportional
+//to the number of elements removed
+func (b *base[K, V]) RemoveExpired(now time.Time, limit int) int {
+	count := 0
+	for count < limit && len(b.expiry) > 0 && b.expiry[0].expired(now) {
+		b.drop(b.expiry[0])
+		count++
+	}
+	return count
+}
+
+//drop all nodes, OnDroped is called for each
+func (b *base[K, V]) clear() {
+	if b.OnDroped != nil {
+		for _, n := range b.items {
+			b.OnDroped(n.key, n.val)
+		}
+	}
+	b.items = nil
+	b.expiry = nil
+	b.bytes = 0
+}
+
+//return number of element in cache
+func (b *base[K, V]) Len() int {
+	return len(b.items)
+}
+
+//return sum of Size of all elements
+func (b *base[K, V]) Bytes() int64 {
+	return b.bytes
+}
+
+//recompute Size of all elements, call it after Size starts to return
+//different results for elements already in cache
+func (b *base[K, V]) Recount() {
+	b.bytes = 0
+	for _, n := range b.items {
+		n.size = b.sizeOf(n.key, n.val)
+		b.bytes += n.size
+	}
+}
+
+//bytes counted for an element
+func (b *base[K, V]) sizeOf(key K, val V) int64 {
+	if b.Size == nil {
+		return 0
+	}
+	return b.Size(key, val)
+}
+
+//min-heap of nodes ordered by expireAt, implements heap.Interface
+type expiryHeap[K comparable, V any] []*node[K, V]
+
+func (h expiryHeap[K, V]) Len() int { return len(h) }
+
+func (h expiryHeap[K, V]) Less(i, j int) bool { return h[i].expireAt.Before(h[j].expireAt) }
+
+func (h expiryHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[K, V]) Push(x interface{}) {
+	n := x.(*node[K, V])
+	n.index = len(*h)
+	*h = append(*h, n)
+}
+
+func (h *expiryHeap[K, V]) Pop() interface{} {
+	old := *h
+	last := len(old) - 1
+	n := old[last]
+	old[last] = nil
+	n.index = -1
+	*h = old[:last]
+	return n
+}
@@ -0,0 +1,64 @@
+package lru
+
+import "time"
+
+//a type-safe LRU cache with TTL. zero value is ready to use, not concurrency
+//safe
+type Cache[K comparable, V any] struct {
+	base[K, V]
+	list nodeList[K, V]
+}
+
+//create a new LRU cache
+func NewCache[K comparable, V any]() *Cache[K, V] {
+	return &Cache[K, V]{}
+}
+
+//add element to cache. if key exists, its value is replaced and the old value
+//is returned with replaced = true. OnDroped is not called for the old value
+func (c *Cache[K, V]) Add(key K, val V, ttl time.Duration) (old V, replaced bool) {
+	c.lazyInit()
+	now := time.Now()
+	if n, ok := c.items[key]; ok {
+		c.list.moveToFront(n)
+		return c.update(n, val, ttl, now), true
+	}
+	c.list.pushFront(c.newNode(key, val, ttl, now))
+	return old, false
+}
+
+//look up cache according to key. expired element is deleted and treated as
+//a miss. in sliding mode, a hit pushes expiration forward
+func (c *Cache[K, V]) Get(key K) (val V, ok bool) {
+	if item, ok := c.GetItem(key); ok {
+		return item.Val, true
+	}
+	return val, false
+}
+
+//same as Get, but return a copy of the element along with its expiration
+func (c *Cache[K, V]) GetItem(key K) (item Item[K, V], ok bool) {
+	n, hit := c.items[key]
+	if !hit || !c.hit(n, time.Now()) {
+		return item, false
+	}
+	c.list.moveToFront(n)
+	return n.item(), true
+}
+
+//remove least recently used element, OnDroped is called as for Del.
+//return false if cache is empty
+func (c *Cache[K, V]) RemoveOldest() (key K, val V, ok bool) {
+	n := c.list.back()
+	if n == nil {
+		return key, val, false
+	}
+	c.evict(n)
+	return n.key, n.val, true
+}
+
+//clear all cache, OnDroped is called for each element
+func (c *Cache[K, V]) Clear() {
+	c.clear()
+	c.list = nodeList[K, V]{}
+}
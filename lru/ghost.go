@@ -0,0 +1,52 @@
+package lru
+
+//keys recently evicted, without values. used by scan resistant caches to
+//recognize an element coming back soon after eviction
+type ghostList[K comparable, V any] struct {
+	list nodeList[K, V]
+	keys map[K]*node[K, V]
+}
+
+//remember key as the most recently evicted
+func (g *ghostList[K, V]) push(key K) {
+	if g.keys == nil {
+		g.keys = make(map[K]*node[K, V])
+	}
+	if n, ok := g.keys[key]; ok {
+		g.list.moveToFront(n)
+		return
+	}
+	n := &node[K, V]{key: key}
+	g.keys[key] = n
+	g.list.pushFront(n)
+}
+
+//forget key, return false if not remembered
+func (g *ghostList[K, V]) remove(key K) bool {
+	n, ok := g.keys[key]
+	if ok {
+		g.list.remove(n)
+		delete(g.keys, key)
+	}
+	return ok
+}
+
+//forget the oldest keys until at most max are remembered
+func (g *ghostList[K, V]) trim(max int) {
+	for g.list.len > max {
+		n := g.list.back()
+		g.list.remove(n)
+		delete(g.keys, n.key)
+	}
+}
+
+//number of keys remembered
+func (g *ghostList[K, V]) len() int {
+	return g.list.len
+}
+
+//forget all keys
+func (g *ghostList[K, V]) clear() {
+	g.list = nodeList[K, V]{}
+	g.keys = nil
+}
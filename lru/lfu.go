@@ -0,0 +1,156 @@
+package lru
+
+import (
+	"container/heap"
+	"time"
+)
+
+//LFU cache evicts the element accessed least often, ties are broken by
+//recency. frequencies are halved periodically (aging), so that elements that
+//were hot long ago do not stay forever. aging is driven by hits only, a scan
+//adding many new elements does not wipe out frequencies of hot ones. zero
+//value is ready to use, not concurrency safe
+type LFU[K comparable, V any] struct {
+	base[K, V]
+	heap freqHeap[K, V]
+
+	clock  uint64 //logical time, increased on every access
+	ticks  uint64 //hits since last aging
+	period uint64 //hits between two agings, 0 means 10 * Len
+}
+
+//create a new LFU cache. frequencies are halved every period hits, 0 means
+//10 times the number of elements in cache
+func NewLFU[K comparable, V any](period uint64) *LFU[K, V] {
+	return &LFU[K, V]{period: period}
+}
+
+//lazy initialization
+func (l *LFU[K, V]) lazyInit() {
+	if l.items == nil {
+		l.base.lazyInit()
+		l.detach = func(n *node[K, V]) {
+			heap.Remove(&l.heap, n.pos)
+		}
+	}
+}
+
+//record an access of n
+func (l *LFU[K, V]) access(n *node[K, V]) {
+	l.clock++
+	n.seq = l.clock
+	if n.freq < ^uint32(0) {
+		n.freq++
+	}
+	heap.Fix(&l.heap, n.pos)
+}
+
+//record a hit of n, frequencies are aged every period hits
+func (l *LFU[K, V]) onHit(n *node[K, V]) {
+	l.access(n)
+	l.ticks++
+	period := l.period
+	if period == 0 {
+		period = 10 * uint64(len(l.items))
+	}
+	if l.ticks >= period {
+		l.age()
+	}
+}
+
+//halve all frequencies
+func (l *LFU[K, V]) age() {
+	l.ticks = 0
+	for _, n := range l.heap {
+		n.freq >>= 1
+	}
+	heap.Init(&l.heap)
+}
+
+//add element to cache. if key exists, its value is replaced and the old value
+//is returned with replaced = true. OnDroped is not called for the old value.
+//writing counts as an access
+func (l *LFU[K, V]) Add(key K, val V, ttl time.Duration) (old V, replaced bool) {
+	l.lazyInit()
+	now := time.Now()
+	if n, ok := l.items[key]; ok {
+		old = l.update(n, val, ttl, now)
+		l.access(n)
+		return old, true
+	}
+	n := l.newNode(key, val, ttl, now)
+	heap.Push(&l.heap, n)
+	l.access(n)
+	return old, false
+}
+
+//look up cache according to key. expired element is deleted and treated as
+//a miss. in sliding mode, a hit pushes expiration forward
+func (l *LFU[K, V]) Get(key K) (val V, ok bool) {
+	if item, ok := l.GetItem(key); ok {
+		return item.Val, true
+	}
+	return val, false
+}
+
+//same as Get, but return a copy of the element along with its expiration
+func (l *LFU[K, V]) GetItem(key K) (item Item[K, V], ok bool) {
+	n, hit := l.items[key]
+	if !hit || !l.hit(n, time.Now()) {
+		return item, false
+	}
+	l.onHit(n)
+	return n.item(), true
+}
+
+//remove least frequently used element, OnDroped is called as for Del.
+//return false if cache is empty
+func (l *LFU[K, V]) RemoveOldest() (key K, val V, ok bool) {
+	if len(l.heap) == 0 {
+		return key, val, false
+	}
+	n := l.heap[0]
+	l.evict(n)
+	return n.key, n.val, true
+}
+
+//clear all cache, OnDroped is called for each element
+func (l *LFU[K, V]) Clear() {
+	l.clear()
+	l.heap = nil
+	l.ticks = 0
+}
+
+//min-heap of nodes ordered by (freq, seq), implements heap.Interface
+type freqHeap[K comparable, V any] []*node[K, V]
+
+func (h freqHeap[K, V]) Len() int { return len(h) }
+
+func (h freqHeap[K, V]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h freqHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *freqHeap[K, V]) Push(x interface{}) {
+	n := x.(*node[K, V])
+	n.pos = len(*h)
+	*h = append(*h, n)
+}
+
+func (h *freqHeap[K, V]) Pop() interface{} {
+	old := *h
+	last := len(old) - 1
+	n := old[last]
+	old[last] = nil
+	n.pos = -1
+	*h = old[:last]
+	return n
+}
@@ -0,0 +1,104 @@
+package lru
+
+import "time"
+
+//element of cache, linked into exactly one nodeList while it is in cache
+type node[K comparable, V any] struct {
+	key  K
+	val  V
+	size int64 //bytes counted for the element, see Config.Size
+
+	expireAt time.Time
+	ttl      time.Duration //idle timeout, used to extend expireAt on hit in sliding mode
+	deadline time.Time     //expireAt never goes beyond deadline. zero means no limit
+	index    int           //position in expiry heap
+
+	//intrusive doubly linked list
+	prev, next *node[K, V]
+	list       *nodeList[K, V]
+
+	//bookkeeping of frequency based caches
+	freq uint32 //access frequency
+	seq  uint64 //logical time of last access
+	pos  int    //position in frequency heap
+}
+
+//whether the element is expired at the moment now
+func (n *node[K, V]) expired(now time.Time) bool {
+	return now.After(n.expireAt)
+}
+
+//reset expireAt as if the element is just accessed at the moment now
+func (n *node[K, V]) touch(now time.Time) {
+	n.expireAt = now.Add(n.ttl)
+	if !n.deadline.IsZero() && n.expireAt.After(n.deadline) {
+		n.expireAt = n.deadline
+	}
+}
+
+//copy of n
+func (n *node[K, V]) item() Item[K, V] {
+	return Item[K, V]{Key: n.key, Val: n.val, ExpireAt: n.expireAt}
+}
+
+//doubly linked list of nodes with a sentinel, front is the most recently used.
+//unlike container/list no interface{} boxing is needed
+type nodeList[K comparable, V any] struct {
+	root node[K, V]
+	len  int
+}
+
+//lazy initialization of sentinel
+func (l *nodeList[K, V]) lazyInit() {
+	if l.root.next == nil {
+		l.root.next = &l.root
+		l.root.prev = &l.root
+	}
+}
+
+//insert n after at
+func (l *nodeList[K, V]) insert(n, at *node[K, V]) {
+	n.prev = at
+	n.next = at.next
+	at.next.prev = n
+	at.next = n
+	n.list = l
+	l.len++
+}
+
+//push n to the front
+func (l *nodeList[K, V]) pushFront(n *node[K, V]) {
+	l.lazyInit()
+	l.insert(n, &l.root)
+}
+
+//push n to the back
+func (l *nodeList[K, V]) pushBack(n *node[K, V]) {
+	l.lazyInit()
+	l.insert(n, l.root.prev)
+}
+
+//unlink n, n must be in l
+func (l *nodeList[K, V]) remove(n *node[K, V]) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next, n.list = nil, nil, nil
+	l.len--
+}
+
+//move n to the front, n must be in l
+func (l *nodeList[K, V]) moveToFront(n *node[K, V]) {
+	if l.root.next == n {
+		return
+	}
+	l.remove(n)
+	l.insert(n, &l.root)
+}
+
+//return the last node, nil if empty
+func (l *nodeList[K, V]) back() *node[K, V] {
+	if l.len == 0 {
+		return nil
+	}
+	return l.root.prev
+}
@@ -5,121 +5,138 @@ import (
 	"time"
 )
 
-//a LRU cache with TTL
+//a LRU cache with TTL, storing interface{} keys and values.
+//thin wrapper of Cache kept for compatibility, prefer Cache in new code
 type LRUCache struct {
-	//list and hash map
-	list  *list.List
-	cache map[interface{}]*list.Element
+	c *Cache[interface{}, *Entry]
 
 	//callback when element is deleted
 	OnDroped func(key interface{}, val interface{})
+
+	//sliding expiration: every hit pushes ExpireAt forward by the ttl passed
+	//to Add, so an element lives as long as it keeps being read
+	Sliding bool
+
+	//absolute max lifetime of an element when Sliding is on, counting from the
+	//moment it is added. zero means no limit
+	MaxLifetime time.Duration
 }
 
-//value of list node
+//value of list node. Get returns the entry stored in cache, so Val set through
+//it is seen by later Get. ExpireAt, TTL and Deadline are refreshed on every Get
+//and Add but only reported, setting them does not change expiration, call Add
+//instead
 type Entry struct {
 	Key      interface{}
 	Val      interface{}
 	ExpireAt time.Time
+
+	//idle timeout, used to extend ExpireAt on hit in sliding mode
+	TTL time.Duration
+
+	//ExpireAt never goes beyond Deadline. zero means no limit
+	Deadline time.Time
 }
 
 //creat a new LRU cache
 func New() *LRUCache {
-	return &LRUCache{
-		list:  list.New(),
-		cache: make(map[interface{}]*list.Element),
-	}
+	return &LRUCache{}
 }
 
-//add element to cache
-func (l *LRUCache) Add(key interface{}, val interface{}, ttl time.Duration) {
-	//lazy initialization
-	if l.cache == nil {
-		l.cache = make(map[interface{}]*list.Element)
-		l.list = list.New()
+//lazy initialization, and pick up config set after creation
+func (l *LRUCache) cache() *Cache[interface{}, *Entry] {
+	if l.c == nil {
+		l.c = NewCache[interface{}, *Entry]()
+		l.c.OnDroped = func(key interface{}, e *Entry) {
+			if l.OnDroped != nil {
+				l.OnDroped(key, e.Val)
+			}
+		}
 	}
+	l.c.Sliding = l.Sliding
+	l.c.MaxLifetime = l.MaxLifetime
+	return l.c
+}
 
-	//if key exists, update and move to head
-	node, ok := l.cache[key]
-	if ok {
-		l.list.MoveToFront(node)
-		nodeEntry := node.Value.(*Entry)
-		nodeEntry.Val = val
-		nodeEntry.ExpireAt = time.Now().Add(ttl)
+//add element to cache. if key exists, its value is replaced, OnDroped is not
+//called for the old value. Cache.Add returns the old value
+func (l *LRUCache) Add(key interface{}, val interface{}, ttl time.Duration) {
+	c := l.cache()
+	if n, ok := c.items[key]; ok {
+		//keep the entry, so that entries returned by Get stay in cache
+		e := n.val
+		e.Val = val
+		c.Add(key, e, ttl)
+		entryOf(n)
 		return
 	}
-
-	//add new element
-	newNode := l.list.PushFront(&Entry{key, val, time.Now().Add(ttl)})
-	l.cache[key] = newNode
+	c.Add(key, &Entry{Key: key, Val: val}, ttl)
+	entryOf(c.items[key])
 }
 
-//look up cache according to key
+//look up cache according to key. expired element is deleted and treated as
+//a miss. in sliding mode, a hit pushes ExpireAt forward. the entry returned is
+//the one stored in cache, see Entry
 func (l *LRUCache) Get(key interface{}) (node *Entry, ok bool) {
-	if l.cache == nil {
-		return
+	c := l.cache()
+	if _, ok = c.GetItem(key); !ok {
+		return nil, false
 	}
-	if node, hit := l.cache[key]; hit {
-		l.list.MoveToFront(node)
-		return node.Value.(*Entry), true
-	}
-	return
+	return entryOf(c.items[key]), true
+}
+
+//entry stored in n, with expiration copied from n
+func entryOf(n *node[interface{}, *Entry]) *Entry {
+	e := n.val
+	e.ExpireAt = n.expireAt
+	e.TTL = n.ttl
+	e.Deadline = n.deadline
+	return e
 }
 
 //delete cache according key
 func (l *LRUCache) Del(key interface{}) {
-	if l.cache == nil {
-		return
-	}
-	if _, hit := l.cache[key]; hit {
-		l.removeCache(key)
-	}
+	l.cache().Del(key)
 }
 
-//remove least recently used cache
+//remove least recently used cache, OnDroped is called as for Del.
+//Cache.RemoveOldest reports what is removed
 func (l *LRUCache) RemoveLeastUsed() {
-	if l.cache == nil {
-		return
-	}
-	target := l.list.Back()
-	if target != nil {
-		l.list.Remove(target)
-		key := target.Value.(*Entry).Key
-		delete(l.cache, key)
-	}
+	l.cache().RemoveOldest()
 }
 
-//remove cache
-func (l *LRUCache) removeCache(key interface{}) {
-	entry := l.cache[key].Value.(*Entry)
-	l.list.Remove(l.cache[key])
-	delete(l.cache, key)
-	if l.OnDroped != nil {
-		l.OnDroped(key, entry.Val)
-	}
+//remove at most limit elements that are expired at the moment now, earliest
+//expired first. return number of elements removed. work done is proportional
+//to the number of elements removed
+func (l *LRUCache) RemoveExpired(now time.Time, limit int) int {
+	return l.cache().RemoveExpired(now, limit)
 }
 
 //return number of element in cache
 func (l *LRUCache) Len() int {
-	if l.cache == nil {
-		return 0
-	}
-	return l.list.Len()
+	return l.cache().Len()
 }
 
 //clear all cache
 func (l *LRUCache) Clear() {
-	if l.cache == nil {
-		return
-	}
-	if l.OnDroped != nil {
-		for k, v := range l.cache {
-			l.OnDroped(k, v.Value.(*Entry).Val)
-		}
-	}
-	l.cache = nil
-	l.list = nil
+	l.cache().Clear()
 }
 
+//return all elements, keyed on key with the stored *Entry as Value of each
+//list.Element.
+//
+//Deprecated: cache is no longer kept in a container/list, so the map is a
+//snapshot built on every call and deleting from it changes nothing. use
+//RemoveExpired to drop expired elements
 func (l *LRUCache) GetAllCache() map[interface{}]*list.Element {
-	return l.cache
+	c := l.cache()
+	if c.items == nil {
+		return nil
+	}
+	res := make(map[interface{}]*list.Element, len(c.items))
+	all := list.New()
+	for key, n := range c.items {
+		res[key] = all.PushBack(entryOf(n))
+	}
+	return res
 }
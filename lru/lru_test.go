@@ -6,6 +6,12 @@ import (
 	"time"
 )
 
+//LRUCache keeps its API from before Cache
+var (
+	_ func(key interface{}, val interface{}, ttl time.Duration) = New().Add
+	_ func()                                                    = New().RemoveLeastUsed
+)
+
 func TestLRUCache(t *testing.T) {
 	//测试Add
 	c1 := New()
@@ -16,3 +22,103 @@ func TestLRUCache(t *testing.T) {
 		t.Errorf("get %s", node.ExpireAt)
 	}
 }
+
+func TestSlidingExpiration(t *testing.T) {
+	c := New()
+	c.Sliding = true
+	c.MaxLifetime = 500 * time.Millisecond
+	c.Add("k", 1, 200*time.Millisecond)
+
+	//keep reading, each hit pushes expiry forward
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, ok := c.Get("k"); !ok {
+			t.Fatalf("expired after %d reads", i)
+		}
+	}
+
+	//bounded by max lifetime
+	time.Sleep(250 * time.Millisecond)
+	if _, ok := c.Get("k"); ok {
+		t.Errorf("alive beyond max lifetime")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expired element not deleted")
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	c := New()
+	for i := 0; i < 10; i++ {
+		c.Add(i, i, time.Duration(i)*time.Hour)
+	}
+	now := time.Now().Add(5*time.Hour + time.Minute)
+
+	//limited per call, earliest expired first
+	if n := c.RemoveExpired(now, 4); n != 4 {
+		t.Errorf("removed %d but want 4", n)
+	}
+	if _, ok := c.Get(4); !ok {
+		t.Errorf("4 removed before 0~3")
+	}
+	if n := c.RemoveExpired(now, 100); n != 2 {
+		t.Errorf("removed %d but want 2", n)
+	}
+	if c.Len() != 4 {
+		t.Errorf("got %d elements but want 4", c.Len())
+	}
+}
+
+func TestCacheBytes(t *testing.T) {
+	c := NewCache[string, []byte]()
+	dropped := map[string]bool{}
+	c.Size = func(key string, val []byte) int64 { return int64(len(key) + len(val)) }
+	c.OnDroped = func(key string, val []byte) { dropped[key] = true }
+
+	c.Add("a", []byte("1"), time.Minute)
+	c.Add("b", []byte("12"), time.Minute)
+	if old, replaced := c.Add("a", []byte("123"), time.Minute); !replaced || string(old) != "1" {
+		t.Errorf("got old value %q, replaced %v", old, replaced)
+	}
+	if c.Bytes() != 7 {
+		t.Errorf("got %d bytes but want 7", c.Bytes())
+	}
+
+	//b is least recently used
+	if key, _, ok := c.RemoveOldest(); !ok || key != "b" {
+		t.Errorf("removed %q but want b", key)
+	}
+	c.Del("a")
+	if c.Bytes() != 0 || !dropped["a"] || !dropped["b"] {
+		t.Errorf("got %d bytes, dropped %v", c.Bytes(), dropped)
+	}
+}
+
+func TestEntryPointer(t *testing.T) {
+	c := New()
+	c.Add("k", 1, time.Minute)
+	e, _ := c.Get("k")
+	e.Val = 2
+	if e, _ := c.Get("k"); e.Val != 2 || e.TTL != time.Minute {
+		t.Errorf("got %+v", e)
+	}
+
+	//Add keeps the entry
+	c.Add("k", 3, time.Hour)
+	if e.Val != 3 || e.TTL != time.Hour {
+		t.Errorf("got %+v after Add", e)
+	}
+}
+
+func TestGetAllCache(t *testing.T) {
+	c := New()
+	if c.GetAllCache() != nil {
+		t.Errorf("got elements of empty cache")
+	}
+	c.Add("a", 1, time.Minute)
+	c.Add("b", 2, time.Minute)
+	all := c.GetAllCache()
+	if len(all) != 2 || all["a"].Value.(*Entry).Val != 1 {
+		t.Errorf("got %v", all)
+	}
+}
@@ -0,0 +1,164 @@
+package lru
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+//common interface of caches in this package, as used by tests
+type policy interface {
+	Add(key string, val int, ttl time.Duration) (int, bool)
+	Get(key string) (int, bool)
+	RemoveOldest() (string, int, bool)
+	Len() int
+}
+
+func stringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+//all policies under test, by name
+func policies() map[string]func() policy {
+	return map[string]func() policy{
+		"lru":     func() policy { return NewCache[string, int]() },
+		"lfu":     func() policy { return NewLFU[string, int](0) },
+		"tinylfu": func() policy { return NewTinyLFU[string, int](stringHash) },
+		"arc":     func() policy { return NewARC[string, int]() },
+		"2q":      func() policy { return NewTwoQ[string, int]() },
+	}
+}
+
+//replay trace on a cache holding at most capacity elements, missed keys are
+//added. return hit rate
+func hitRate(p policy, trace []string, capacity int) float64 {
+	hits := 0
+	for _, key := range trace {
+		if _, ok := p.Get(key); ok {
+			hits++
+			continue
+		}
+		p.Add(key, 0, time.Hour)
+		for p.Len() > capacity {
+			p.RemoveOldest()
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+//zipf distributed accesses over n keys, interrupted by a scan over scan
+//unique keys every period accesses, like a nightly report iterating all keys
+func zipfTrace(length, n, scan, period int) []string {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, uint64(n-1))
+	res := make([]string, 0, length)
+	scanned := 0
+	for len(res) < length {
+		if period > 0 && len(res)%period == period-1 {
+			for i := 0; i < scan; i++ {
+				res = append(res, fmt.Sprintf("scan%d", scanned))
+				scanned++
+			}
+		}
+		res = append(res, fmt.Sprintf("key%d", z.Uint64()))
+	}
+	return res
+}
+
+//load a recorded trace, one key per line
+func loadTrace(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		res = append(res, scanner.Text())
+	}
+	return res, scanner.Err()
+}
+
+func TestScanResistance(t *testing.T) {
+	for name, create := range policies() {
+		if name == "lru" {
+			continue
+		}
+		p := create()
+		//hot keys are read many times
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("hot%d", i)
+				if _, ok := p.Get(key); !ok {
+					p.Add(key, i, time.Hour)
+				}
+			}
+		}
+		//one large scan
+		for i := 0; i < 10000; i++ {
+			p.Add(fmt.Sprintf("scan%d", i), i, time.Hour)
+			for p.Len() > 100 {
+				p.RemoveOldest()
+			}
+		}
+		kept := 0
+		for i := 0; i < 50; i++ {
+			if _, ok := p.Get(fmt.Sprintf("hot%d", i)); ok {
+				kept++
+			}
+		}
+		if kept < 45 {
+			t.Errorf("%v: only %d of 50 hot keys survive the scan", name, kept)
+		}
+	}
+}
+
+func TestLFUAging(t *testing.T) {
+	c := NewLFU[string, int](100)
+	c.Add("old", 0, time.Hour)
+	for i := 0; i < 60; i++ {
+		c.Get("old")
+	}
+	//old stops being read, new is read from now on
+	c.Add("new", 0, time.Hour)
+	for i := 0; i < 500; i++ {
+		c.Get("new")
+	}
+	if key, _, _ := c.RemoveOldest(); key != "old" {
+		t.Errorf("evicted %v but want old", key)
+	}
+}
+
+//hit rate of every policy on a zipf workload with periodic scans, and on a
+//recorded trace if LRU_TRACE is set to a file with one key per line
+func BenchmarkHitRate(b *testing.B) {
+	traces := map[string][]string{
+		"zipf":      zipfTrace(200000, 10000, 0, 0),
+		"zipf+scan": zipfTrace(200000, 10000, 2000, 20000),
+	}
+	if path := os.Getenv("LRU_TRACE"); path != "" {
+		trace, err := loadTrace(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		traces["recorded"] = trace
+	}
+	for traceName, trace := range traces {
+		for name, create := range policies() {
+			b.Run(traceName+"/"+name, func(b *testing.B) {
+				var rate float64
+				for i := 0; i < b.N; i++ {
+					rate = hitRate(create(), trace, 1000)
+				}
+				b.ReportMetric(rate*100, "hit%")
+			})
+		}
+	}
+}
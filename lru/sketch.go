@@ -0,0 +1,109 @@
+package lru
+
+//count-min sketch estimating access frequency of keys with 4-bit saturating
+//counters, halved every [sampleFactor] * width increments so that estimates
+//follow recent history
+type sketch struct {
+	rows  [sketchDepth][]uint8
+	mask  uint64
+	adds  uint64 //increments since last reset
+	limit uint64 //reset when adds reaches limit
+}
+
+const (
+	sketchDepth  = 4
+	sketchMax    = 15 //counters saturate at 15, as 4-bit counters would
+	sampleFactor = 10
+	minWidth     = 64
+)
+
+//create a sketch for about n distinct keys
+func newSketch(n int) *sketch {
+	width := minWidth
+	for width < n {
+		width <<= 1
+	}
+	s := &sketch{
+		mask:  uint64(width - 1),
+		limit: uint64(sampleFactor * width),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+//double width until it is at least n, counters are copied so that every key
+//keeps its estimate
+func (s *sketch) grow(n int) {
+	width := s.width()
+	for width < n {
+		width <<= 1
+	}
+	if width == s.width() {
+		return
+	}
+	oldMask := s.mask
+	for i := range s.rows {
+		row := make([]uint8, width)
+		for j := range row {
+			row[j] = s.rows[i][uint64(j)&oldMask]
+		}
+		s.rows[i] = row
+	}
+	s.mask = uint64(width - 1)
+	s.limit = uint64(sampleFactor * width)
+}
+
+//number of counters per row
+func (s *sketch) width() int {
+	return len(s.rows[0])
+}
+
+//index of key hash h in row i, by double hashing. h is rehashed first, in case
+//the caller's hash is also used to pick a shard and its low bits are fixed
+func (s *sketch) index(h uint64, i int) uint64 {
+	h *= 0x9e3779b97f4a7c15
+	h ^= h >> 29
+	h1, h2 := h, (h>>32)|1
+	return (h1 + uint64(i)*h2) & s.mask
+}
+
+//record an occurrence of key hash h
+func (s *sketch) increment(h uint64) {
+	added := false
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < sketchMax {
+			s.rows[i][idx]++
+			added = true
+		}
+	}
+	if added {
+		s.adds++
+		if s.adds >= s.limit {
+			s.reset()
+		}
+	}
+}
+
+//estimated occurrences of key hash h
+func (s *sketch) estimate(h uint64) uint8 {
+	res := uint8(sketchMax)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < res {
+			res = c
+		}
+	}
+	return res
+}
+
+//halve all counters
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.adds /= 2
+}
@@ -0,0 +1,172 @@
+package lru
+
+import "time"
+
+//W-TinyLFU cache. new elements enter a small LRU window, and move on to the
+//segmented LRU main space (probation + protected) when the window overflows.
+//once main space is full, the oldest element of the window competes with the
+//victim of main space, and the one with lower frequency estimated by a
+//count-min sketch is evicted. a one-off scan therefore only churns the window,
+//while frequently used elements stay in main space. zero value is not ready to
+//use, create it by NewTinyLFU. not concurrency safe
+type TinyLFU[K comparable, V any] struct {
+	base[K, V]
+	hash func(K) uint64
+
+	window    nodeList[K, V] //admission window, about [windowPercent] of capacity
+	probation nodeList[K, V] //main space, elements not hit since entering main
+	protected nodeList[K, V] //main space, hit elements, at most [protectedPercent] of main
+
+	//number of elements when the cache is full. capacity is unknown to the
+	//cache as it is bounded by bytes, so it is learned from Len every time
+	//eviction is needed
+	capacity int
+
+	sketch *sketch
+}
+
+const (
+	windowPercent    = 1
+	protectedPercent = 80
+)
+
+//create a new W-TinyLFU cache, hash must spread keys uniformly over uint64
+func NewTinyLFU[K comparable, V any](hash func(K) uint64) *TinyLFU[K, V] {
+	return &TinyLFU[K, V]{hash: hash, sketch: newSketch(0)}
+}
+
+//record an access of key in sketch, sketch grows with cache
+func (t *TinyLFU[K, V]) record(key K) {
+	t.sketch.grow(len(t.items))
+	t.sketch.increment(t.hash(key))
+}
+
+//add element to cache. if key exists, its value is replaced and the old value
+//is returned with replaced = true. OnDroped is not called for the old value.
+//new element enters the window
+func (t *TinyLFU[K, V]) Add(key K, val V, ttl time.Duration) (old V, replaced bool) {
+	t.lazyInit()
+	t.record(key)
+	now := time.Now()
+	if n, ok := t.items[key]; ok {
+		old = t.update(n, val, ttl, now)
+		t.promote(n)
+		return old, true
+	}
+	t.window.pushFront(t.newNode(key, val, ttl, now))
+	return old, false
+}
+
+//look up cache according to key. expired element is deleted and treated as
+//a miss. in sliding mode, a hit pushes expiration forward. misses are also
+//counted in frequency
+func (t *TinyLFU[K, V]) Get(key K) (val V, ok bool) {
+	if item, ok := t.GetItem(key); ok {
+		return item.Val, true
+	}
+	return val, false
+}
+
+//same as Get, but return a copy of the element along with its expiration
+func (t *TinyLFU[K, V]) GetItem(key K) (item Item[K, V], ok bool) {
+	t.record(key)
+	n, hit := t.items[key]
+	if !hit || !t.hit(n, time.Now()) {
+		return item, false
+	}
+	t.promote(n)
+	return n.item(), true
+}
+
+//move n on hit: within window it is moved to front and remembered as hit, in
+//probation it is promoted to protected
+func (t *TinyLFU[K, V]) promote(n *node[K, V]) {
+	switch n.list {
+	case &t.window:
+		n.freq = 1
+		t.window.moveToFront(n)
+	case &t.protected:
+		t.protected.moveToFront(n)
+	case &t.probation:
+		t.probation.remove(n)
+		t.protected.pushFront(n)
+		t.balance()
+	}
+}
+
+//demote protected overflow to probation. protected is bounded by the share of
+//capacity once capacity is learned, by the share of main space before
+func (t *TinyLFU[K, V]) balance() {
+	main := t.probation.len + t.protected.len
+	if t.capacity > main {
+		main = t.capacity
+	}
+	for t.protected.len > 1 && t.protected.len*100 > main*protectedPercent {
+		demoted := t.protected.back()
+		t.protected.remove(demoted)
+		t.probation.pushFront(demoted)
+	}
+}
+
+//move the oldest element of window to main space. it goes to protected if it
+//has been hit in window
+func (t *TinyLFU[K, V]) admit() {
+	n := t.window.back()
+	t.window.remove(n)
+	if n.freq > 0 {
+		t.protected.pushFront(n)
+		t.balance()
+	} else {
+		t.probation.pushFront(n)
+	}
+}
+
+//evict an element, OnDroped is called as for Del. window overflow moves to
+//main space while main space has room, then the oldest element of the window
+//competes with the victim of main space and the one less frequently used is
+//evicted. return false if cache is empty
+func (t *TinyLFU[K, V]) RemoveOldest() (key K, val V, ok bool) {
+	if len(t.items) == 0 {
+		return key, val, false
+	}
+
+	//the cache is full now
+	t.capacity = len(t.items) - 1
+	windowCap := t.capacity * windowPercent / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	for t.window.len > windowCap && t.probation.len+t.protected.len < t.capacity-windowCap {
+		t.admit()
+	}
+
+	var candidate, victim *node[K, V]
+	if t.window.len > windowCap || t.window.len == len(t.items) {
+		candidate = t.window.back()
+	}
+	if victim = t.probation.back(); victim == nil {
+		victim = t.protected.back()
+	}
+
+	target := victim
+	switch {
+	case victim == nil:
+		target = candidate
+	case candidate == nil:
+	case t.sketch.estimate(t.hash(candidate.key)) > t.sketch.estimate(t.hash(victim.key)):
+		t.admit()
+	default:
+		target = candidate
+	}
+	t.evict(target)
+	return target.key, target.val, true
+}
+
+//clear all cache, OnDroped is called for each element. frequency history and
+//learned capacity are kept
+func (t *TinyLFU[K, V]) Clear() {
+	t.clear()
+	t.window = nodeList[K, V]{}
+	t.probation = nodeList[K, V]{}
+	t.protected = nodeList[K, V]{}
+}
@@ -0,0 +1,109 @@
+package lru
+
+import "time"
+
+//2Q cache. new elements enter a1in, and only move to the LRU am once they are
+//hit, so a scan passes through a1in only. keys evicted from a1in are
+//remembered in the ghost list a1out, and an element added again while its key
+//is in a1out is considered hot and enters am directly. capacity is learned
+//from Len every time eviction is needed, as the cache is bounded by bytes.
+//zero value is ready to use, not concurrency safe
+type TwoQ[K comparable, V any] struct {
+	base[K, V]
+
+	a1in  nodeList[K, V]  //elements seen once, about [a1inPercent] of capacity
+	a1out ghostList[K, V] //keys evicted from a1in, about [a1outPercent] of capacity
+	am    nodeList[K, V]  //LRU of hot elements
+
+	capacity int //number of elements when the cache is full
+}
+
+const (
+	a1inPercent  = 25
+	a1outPercent = 50
+)
+
+//create a new 2Q cache
+func NewTwoQ[K comparable, V any]() *TwoQ[K, V] {
+	return &TwoQ[K, V]{}
+}
+
+//add element to cache. if key exists, its value is replaced and the old value
+//is returned with replaced = true. OnDroped is not called for the old value.
+//a key remembered in a1out enters am, other new keys enter a1in
+func (q *TwoQ[K, V]) Add(key K, val V, ttl time.Duration) (old V, replaced bool) {
+	q.lazyInit()
+	now := time.Now()
+	if n, ok := q.items[key]; ok {
+		old = q.update(n, val, ttl, now)
+		q.promote(n)
+		return old, true
+	}
+	n := q.newNode(key, val, ttl, now)
+	if q.a1out.remove(key) {
+		q.am.pushFront(n)
+	} else {
+		q.a1in.pushFront(n)
+	}
+	return old, false
+}
+
+//look up cache according to key. expired element is deleted and treated as
+//a miss. in sliding mode, a hit pushes expiration forward
+func (q *TwoQ[K, V]) Get(key K) (val V, ok bool) {
+	if item, ok := q.GetItem(key); ok {
+		return item.Val, true
+	}
+	return val, false
+}
+
+//same as Get, but return a copy of the element along with its expiration
+func (q *TwoQ[K, V]) GetItem(key K) (item Item[K, V], ok bool) {
+	n, hit := q.items[key]
+	if !hit || !q.hit(n, time.Now()) {
+		return item, false
+	}
+	q.promote(n)
+	return n.item(), true
+}
+
+//a hit moves n to the front of am
+func (q *TwoQ[K, V]) promote(n *node[K, V]) {
+	if n.list == &q.am {
+		q.am.moveToFront(n)
+		return
+	}
+	q.a1in.remove(n)
+	q.am.pushFront(n)
+}
+
+//evict the oldest element of a1in if a1in exceeds its share, and remember its
+//key in a1out. otherwise evict the least recently used element of am.
+//OnDroped is called as for Del. return false if cache is empty
+func (q *TwoQ[K, V]) RemoveOldest() (key K, val V, ok bool) {
+	if len(q.items) == 0 {
+		return key, val, false
+	}
+	q.capacity = len(q.items) - 1
+
+	var n *node[K, V]
+	if q.a1in.len > 0 && (q.a1in.len*100 > q.capacity*a1inPercent || q.am.len == 0) {
+		n = q.a1in.back()
+		q.evict(n)
+		q.a1out.push(n.key)
+		q.a1out.trim(maxInt(q.capacity*a1outPercent/100, 1))
+	} else {
+		n = q.am.back()
+		q.evict(n)
+	}
+	return n.key, n.val, true
+}
+
+//clear all cache, OnDroped is called for each element. a1out is dropped as
+//well
+func (q *TwoQ[K, V]) Clear() {
+	q.clear()
+	q.a1in = nodeList[K, V]{}
+	q.am = nodeList[K, V]{}
+	q.a1out.clear()
+}
@@ -0,0 +1,332 @@
+package cache
+
+import (
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//memory pressure is reported once memory used by the process exceeds this
+	//share of the Go runtime memory limit
+	pressureRatio = 0.9
+
+	//an idle group keeps at least 1/idleFloor of its fair share
+	idleFloor = 8
+)
+
+//process level memory manager, shared by all GroupCache
+var manager = &memoryManager{}
+
+//divides a process memory budget among all registered groups. every group gets
+//a fair share by weight, then idle groups are shrunk as far as busy groups that
+//have filled their share need room
+type memoryManager struct {
+	mu sync.Mutex
+
+	//process memory budget, <= 0 means every group keeps its own maxBytes
+	limit int64
+
+	//periodic rebalancing, nil if not running
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	//called on runtime memory limit pressure
+	onPressure func(used, limit int64)
+
+	//state of managed groups, dropped once a group is closed
+	states map[*GroupCache]*groupState
+}
+
+//what the memory manager remembers about a group
+type groupState struct {
+	ownMaxBytes int64 //maxBytes before managed, restored once limit is removed
+	lastGets    int64 //Stats().Gets at last rebalance
+}
+
+//set process memory budget drawn by all GroupCache, so that the sum of their
+//maxBytes never exceeds limit. groups are rebalanced right away, whenever a
+//group is created and every interval, interval <= 0 means only then and on
+//Rebalance. limit <= 0 stops management and gives every group its own maxBytes
+//back
+func SetMemoryLimit(limit int64, interval time.Duration) {
+	manager.setLimit(limit, interval)
+}
+
+//rebalance memory budget among groups at once, nothing happens if there is no
+//process memory budget
+func Rebalance() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.rebalance()
+}
+
+//set a function called when memory used by the process exceeds 90% of the Go
+//runtime memory limit, see debug.SetMemoryLimit. it is checked on every
+//periodic rebalance, and budgets of groups are shrunk by the excess besides
+func SetMemoryPressureHandler(f func(used, limit int64)) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.onPressure = f
+}
+
+//set share of process memory budget relative to other groups, default is 1.
+//weight < 1 is treated as 1
+func (g *GroupCache) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	atomic.StoreInt64(&g.weight, int64(weight))
+}
+
+//set maxBytes of a running GroupCache and evict if it is exceeded. separate
+//budgets of mainCache and hotCache keep their ratio
+func (g *GroupCache) resize(maxBytes int64) {
+	g.budgetMu.Lock()
+	defer g.budgetMu.Unlock()
+	atomic.StoreInt64(&g.maxBytes, maxBytes)
+	if !g.tiered.Load() {
+		g.mainCache.setMaxBytes(maxBytes)
+		g.hotCache.setMaxBytes(maxBytes)
+		g.hotCache.setCapacity(0)
+		g.checkOverflow()
+		return
+	}
+	if g.hotDisabled.Load() || maxBytes <= 0 {
+		g.mainCache.setMaxBytes(maxBytes)
+		return
+	}
+	main := atomic.LoadInt64(&g.mainCache.maxBytes)
+	hot := atomic.LoadInt64(&g.hotCache.maxBytes)
+	if main > 0 {
+		hot = int64(float64(maxBytes) * float64(hot) / float64(main+hot))
+	} else if hot > maxBytes/2 {
+		hot = maxBytes / 2
+	}
+	if hot < 1 {
+		hot = 1
+	}
+	g.mainCache.setMaxBytes(maxBytes - hot)
+	g.hotCache.setMaxBytes(hot)
+}
+
+func (m *memoryManager) setLimit(limit int64, interval time.Duration) {
+	m.mu.Lock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	m.limit = limit
+	if limit <= 0 {
+		//give groups their own budget back
+		for g, st := range m.states {
+			g.resize(st.ownMaxBytes)
+		}
+		m.states = nil
+	} else {
+		m.rebalance()
+	}
+	if limit > 0 && interval > 0 {
+		stop := make(chan struct{})
+		m.stop = stop
+		m.wg.Add(1)
+		go m.loop(interval, stop)
+	}
+	m.mu.Unlock()
+}
+
+//rebalance every interval until stop is closed
+func (m *memoryManager) loop(interval time.Duration, stop chan struct{}) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.mu.Lock()
+			select {
+			case <-stop:
+			default:
+				m.rebalance()
+			}
+			m.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+//called by NewGroupCache
+func (m *memoryManager) groupAdded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rebalance()
+}
+
+//divide limit among groups, m.mu must be held
+func (m *memoryManager) rebalance() {
+	if m.limit <= 0 {
+		return
+	}
+	rw.RLock()
+	list := make([]*GroupCache, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	rw.RUnlock()
+	if len(list) == 0 {
+		return
+	}
+
+	//forget closed groups
+	alive := make(map[*GroupCache]*groupState, len(list))
+	for _, g := range list {
+		st, ok := m.states[g]
+		if !ok {
+			st = &groupState{ownMaxBytes: atomic.LoadInt64(&g.maxBytes)}
+		}
+		alive[g] = st
+	}
+	m.states = alive
+
+	limit := m.limit
+	if used, runtimeLimit, ok := memoryPressure(); ok {
+		var cached int64
+		for _, g := range list {
+			cached += g.Bytes()
+		}
+		excess := used - int64(float64(runtimeLimit)*pressureRatio)
+		if cached-excess < limit {
+			limit = cached - excess
+		}
+		if limit < m.limit/idleFloor {
+			limit = m.limit / idleFloor
+		}
+		logger.GetInstance().WithFields(logrus.Fields{
+			"used":   used,
+			"limit":  runtimeLimit,
+			"budget": limit,
+		}).Warnln("memory pressure, shrink cache budget")
+		if m.onPressure != nil {
+			m.onPressure(used, runtimeLimit)
+		}
+	}
+
+	//fair share by weight. busy groups, active ones that filled their share,
+	//ask for half a fair share more than they have
+	var weights int64
+	weight := make([]int64, len(list))
+	active := make([]bool, len(list))
+	used := make([]int64, len(list))
+	for i, g := range list {
+		weight[i] = atomic.LoadInt64(&g.weight)
+		if weight[i] < 1 {
+			weight[i] = 1
+		}
+		weights += weight[i]
+		gets := atomic.LoadInt64(&g.stats.gets)
+		active[i] = gets != alive[g].lastGets
+		alive[g].lastGets = gets
+		used[i] = g.Bytes()
+	}
+	budget := make([]int64, len(list))
+	busy := make([]bool, len(list))
+	spare := make([]int64, len(list))
+	var demand, spares int64
+	for i, g := range list {
+		fair := limit * weight[i] / weights
+		budget[i] = fair
+		cur := atomic.LoadInt64(&g.maxBytes)
+		if cur < fair {
+			cur = fair
+		}
+		busy[i] = active[i] && used[i] >= cur*9/10
+		if busy[i] {
+			demand += cur + fair/2 - fair
+			continue
+		}
+		if active[i] {
+			continue
+		}
+		//idle groups may give up to half of their usage
+		keep := used[i] / 2
+		if keep < fair/idleFloor {
+			keep = fair / idleFloor
+		}
+		if keep < fair {
+			spare[i] = fair - keep
+			spares += spare[i]
+		}
+	}
+
+	//take from idle groups only what busy groups ask for
+	if demand > spares {
+		demand = spares
+	}
+	left := limit
+	for i := range list {
+		if demand > 0 && spare[i] > 0 {
+			budget[i] -= demand * spare[i] / spares
+		}
+		left -= budget[i]
+	}
+
+	//give the room left to busy groups, or to all active groups, or to
+	//everyone
+	for _, pick := range []func(i int) bool{
+		func(i int) bool { return busy[i] },
+		func(i int) bool { return active[i] },
+		func(i int) bool { return true },
+	} {
+		var w int64
+		for i := range list {
+			if pick(i) {
+				w += weight[i]
+			}
+		}
+		if w == 0 {
+			continue
+		}
+		for i := range list {
+			if pick(i) {
+				budget[i] += left * weight[i] / w
+			}
+		}
+		break
+	}
+
+	for i, g := range list {
+		if budget[i] < 1 {
+			budget[i] = 1
+		}
+		g.resize(budget[i])
+	}
+}
+
+//return memory used by the process and the Go runtime memory limit, ok is
+//true if used exceeds pressureRatio of the limit
+func memoryPressure() (used, limit int64, ok bool) {
+	limit = debug.SetMemoryLimit(-1)
+	if limit <= 0 || limit == math.MaxInt64 {
+		return 0, 0, false
+	}
+	//the same measure the runtime compares with its memory limit
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	for _, s := range samples {
+		if s.Value.Kind() != metrics.KindUint64 {
+			return 0, 0, false
+		}
+	}
+	used = int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+	return used, limit, float64(used) > float64(limit)*pressureRatio
+}
@@ -1,10 +1,14 @@
 package cache
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/hollowdjj/course-selecting-sys/cache/pb"
 
@@ -22,18 +26,63 @@ type Peer interface {
 	Addr() string
 }
 
+//可选接口，实现了Pusher的peer可以接收owner推送的热点key
+type Pusher interface {
+	Push(*pb.PushRequest) error
+}
+
+//可选接口，实现了CASPeer的peer可以执行转发来的CompareAndSet
+type CASPeer interface {
+	CompareAndSet(*pb.CASRequest, *pb.CASResponse) error
+}
+
+//可选接口，实现了CounterPeer的peer可以执行转发来的Incr
+type CounterPeer interface {
+	Incr(*pb.IncrRequest, *pb.IncrResponse) error
+}
+
+//可选接口，实现了LeasePeer的peer可以执行转发来的GetWithLease和SetWithLease，
+//并在其他节点写入或删除key后作废lease
+type LeasePeer interface {
+	Lease(*pb.LeaseRequest, *pb.LeaseResponse) error
+	LeaseSet(*pb.LeaseSetRequest, *pb.LeaseSetResponse) error
+	Invalidate(*pb.InvalidateRequest, *pb.InvalidateResponse) error
+}
+
+//可选接口，实现了StreamPeer的peer可以流式地获取value，大value无需整体缓冲。
+//value以外的字段(如压缩算法)写入resp，value本身从返回的io.ReadCloser读取，
+//读取时会校验每个分块的checksum，调用方负责Close
+type StreamPeer interface {
+	GetStream(*pb.GetRequest, *pb.GetResponse) (io.ReadCloser, error)
+}
+
+//可选接口，实现了PeerLister的PeerPicker可以列出除本机外的所有节点，
+//用于热点key的复制
+type PeerLister interface {
+	AllPeers() []Peer
+}
+
 //http实现的peer
 type httpPeer struct {
 	remoteBaseUrl string //eg: http://xx.xxx.xxx.xx:8000/_dcache
+
+	//client and context owned by HttpPool, nil means http.DefaultClient and
+	//context.Background()
+	client *http.Client
+	ctx    context.Context
 }
 
 func (h *httpPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
 	//拼接完整url
-	url := fmt.Sprintf("%v?group=%v&key=%v", h.remoteBaseUrl,
+	url := fmt.Sprintf("%v?group=%v&key=%v&raw=1", h.remoteBaseUrl,
 		url.QueryEscape(req.GetGroup()), url.QueryEscape(req.GetKey()))
 
 	//发送http请求
-	response, err := http.Get(url)
+	request, err := http.NewRequestWithContext(h.context(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := h.httpClient().Do(request)
 	if err != nil {
 		return err
 	}
@@ -49,6 +98,124 @@ func (h *httpPeer) Get(req *pb.GetRequest, resp *pb.GetResponse) error {
 	return nil
 }
 
+//流式获取value。大value以分块流返回，其余以protobuf返回
+func (h *httpPeer) GetStream(req *pb.GetRequest, resp *pb.GetResponse) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%v?group=%v&key=%v&stream=1&raw=1", h.remoteBaseUrl,
+		url.QueryEscape(req.GetGroup()), url.QueryEscape(req.GetKey()))
+	request, err := http.NewRequestWithContext(h.context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := h.httpClient().Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("server returned: %v", response.Status)
+	}
+	if response.Header.Get(streamHeader) == "1" {
+		codec, _ := strconv.Atoi(response.Header.Get(compressionHeader))
+		resp.Compression = int32(codec)
+		if sum, err := strconv.ParseUint(response.Header.Get(checksumHeader), 10, 32); err == nil {
+			resp.Checksum = proto.Uint32(uint32(sum))
+		}
+		resp.Version, _ = strconv.ParseUint(response.Header.Get(versionHeader), 10, 64)
+		return newFrameReader(response.Body), nil
+	}
+
+	//small value in a protobuf message
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err = proto.Unmarshal(body, resp); err != nil {
+		return nil, fmt.Errorf("Decode protobuf response failed: %v", err)
+	}
+	value := resp.Value
+	resp.Value = nil
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+//把热点key推送到远端节点的hotCache
+func (h *httpPeer) Push(req *pb.PushRequest) error {
+	return h.post(h.remoteBaseUrl, req, nil)
+}
+
+//在key的owner上执行CompareAndSet
+func (h *httpPeer) CompareAndSet(req *pb.CASRequest, resp *pb.CASResponse) error {
+	return h.post(h.remoteBaseUrl+casRoute, req, resp)
+}
+
+//在key的owner上执行Incr
+func (h *httpPeer) Incr(req *pb.IncrRequest, resp *pb.IncrResponse) error {
+	return h.post(h.remoteBaseUrl+incrRoute, req, resp)
+}
+
+//在key的owner上获取lease
+func (h *httpPeer) Lease(req *pb.LeaseRequest, resp *pb.LeaseResponse) error {
+	return h.post(h.remoteBaseUrl+leaseRoute, req, resp)
+}
+
+//在key的owner上用lease写入value
+func (h *httpPeer) LeaseSet(req *pb.LeaseSetRequest, resp *pb.LeaseSetResponse) error {
+	return h.post(h.remoteBaseUrl+leaseSetRoute, req, resp)
+}
+
+//在key的owner上作废lease
+func (h *httpPeer) Invalidate(req *pb.InvalidateRequest, resp *pb.InvalidateResponse) error {
+	return h.post(h.remoteBaseUrl+invalidateRoute, req, resp)
+}
+
+//POST一个protobuf请求，resp为nil时丢弃响应
+func (h *httpPeer) post(url string, req, resp proto.Message) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("Encode protobuf request failed: %v", err)
+	}
+	request, err := http.NewRequestWithContext(h.context(), http.MethodPost,
+		url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	response, err := h.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, response.Body)
+		return fmt.Errorf("server returned: %v", response.Status)
+	}
+	if resp == nil {
+		io.Copy(ioutil.Discard, response.Body)
+		return nil
+	}
+	if body, err = ioutil.ReadAll(response.Body); err != nil {
+		return err
+	}
+	if err = proto.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("Decode protobuf response failed: %v", err)
+	}
+	return nil
+}
+
+func (h *httpPeer) context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
+func (h *httpPeer) httpClient() *http.Client {
+	if h.client == nil {
+		return http.DefaultClient
+	}
+	return h.client
+}
+
 func (h *httpPeer) Addr() string {
 	return h.remoteBaseUrl
 }
@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/arena"
+	"github.com/hollowdjj/course-selecting-sys/cache/lru"
+)
+
+//eviction policy of a cache shard. it decides which entry goes first when the
+//byte budget is exceeded, and keeps TTL and byte accounting of entries.
+//implemented by lru.Cache, lru.LFU, lru.TinyLFU, lru.ARC, lru.TwoQ and
+//arenaPolicy
+type Policy interface {
+	//add entry, return the old value if key exists
+	Add(key string, val Value, ttl time.Duration) (old Value, replaced bool)
+
+	//look up entry, an expired entry is deleted and treated as a miss
+	Get(key string) (Value, bool)
+
+	//look up entry without updating eviction order or expiration
+	Peek(key string) (lru.Item[string, Value], bool)
+
+	//call f on every entry not expired until f returns false, without
+	//updating eviction order or expiration
+	Range(f func(item lru.Item[string, Value]) bool)
+
+	//delete entry, return false if not exist
+	Del(key string) bool
+
+	//evict the entry the policy values least, return false if empty
+	RemoveOldest() (key string, val Value, ok bool)
+
+	//remove at most limit entries expired at the moment now
+	RemoveExpired(now time.Time, limit int) int
+
+	//number of entries and sum of their Size
+	Len() int
+	Bytes() int64
+
+	//recompute Size of all entries
+	Recount()
+
+	//drop all entries
+	Clear()
+
+	//set callbacks, size function and expiration mode
+	Configure(cfg lru.Config[string, Value])
+}
+
+//eviction policy selectable per GroupCache
+type EvictionPolicy int
+
+const (
+	//least recently used, the default
+	PolicyLRU EvictionPolicy = iota
+
+	//least frequently used with aging
+	PolicyLFU
+
+	//W-TinyLFU: windowed LRU + count-min sketch admission + segmented LRU,
+	//resistant to scans
+	PolicyTinyLFU
+
+	//adaptive replacement cache, balances recency and frequency by itself
+	PolicyARC
+
+	//2Q, scans pass through a small queue without touching hot entries
+	Policy2Q
+
+	//keys and values are kept in large byte slabs instead of one object per
+	//entry, so that millions of entries cost the garbage collector nothing.
+	//evicts in insertion order, values are copied out on every hit
+	PolicyArena
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case PolicyLRU:
+		return "lru"
+	case PolicyLFU:
+		return "lfu"
+	case PolicyTinyLFU:
+		return "tinylfu"
+	case PolicyARC:
+		return "arc"
+	case Policy2Q:
+		return "2q"
+	case PolicyArena:
+		return "arena"
+	}
+	return "unknown"
+}
+
+//create an empty policy instance. capacity is the byte budget of it, <= 0
+//means no limit
+func newPolicy(p EvictionPolicy, capacity int64) Policy {
+	switch p {
+	case PolicyArena:
+		return newArenaPolicy(capacity)
+	case PolicyLFU:
+		return lru.NewLFU[string, Value](0)
+	case PolicyTinyLFU:
+		return lru.NewTinyLFU[string, Value](hashKey)
+	case PolicyARC:
+		return lru.NewARC[string, Value]()
+	case Policy2Q:
+		return lru.NewTwoQ[string, Value]()
+	}
+	return lru.NewCache[string, Value]()
+}
+
+//64-bit fnv-1a hash of key
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+//adapts arena.Cache to Policy. Size of Config is ignored, bytes are what slab
+//and index really take, room of slab not yet occupied included. arena keeps bytes only, so metadata of Value is
+//stored in front of them, see encodeArenaValue
+type arenaPolicy struct {
+	c *arena.Cache
+}
+
+//bytes of Value metadata in front of every value in arena, key id excluded
+const arenaHeaderSize = 15
+
+//largest slab preallocated, slab grows on demand up to the byte budget
+const maxArenaPrealloc = 1 << 20
+
+//capacity is the byte budget of arena, slab and index never take more. half
+//of it is preallocated at most, leaving room for index
+func newArenaPolicy(capacity int64) *arenaPolicy {
+	prealloc := capacity / 2
+	if prealloc > maxArenaPrealloc {
+		prealloc = maxArenaPrealloc
+	}
+	c := arena.New(int(prealloc))
+	c.SetLimit(int(capacity))
+	return &arenaPolicy{c: c}
+}
+
+//set byte budget of arena, a larger slab is shrunk at once
+func (a *arenaPolicy) setCapacity(capacity int64) {
+	a.c.SetLimit(int(capacity))
+}
+
+func (a *arenaPolicy) Add(key string, val Value, ttl time.Duration) (Value, bool) {
+	old, replaced := a.c.Add(key, encodeArenaValue(val), ttl)
+	return decodeArenaValue(old), replaced
+}
+
+func (a *arenaPolicy) Get(key string) (Value, bool) {
+	b, ok := a.c.Get(key)
+	return decodeArenaValue(b), ok
+}
+
+func (a *arenaPolicy) Peek(key string) (lru.Item[string, Value], bool) {
+	b, expireAt, ok := a.c.Peek(key)
+	return lru.Item[string, Value]{Key: key, Val: decodeArenaValue(b), ExpireAt: expireAt}, ok
+}
+
+func (a *arenaPolicy) Range(f func(item lru.Item[string, Value]) bool) {
+	a.c.Range(func(key string, b []byte, expireAt time.Time) bool {
+		return f(lru.Item[string, Value]{Key: key, Val: decodeArenaValue(b), ExpireAt: expireAt})
+	})
+}
+
+func (a *arenaPolicy) Del(key string) bool {
+	return a.c.Del(key)
+}
+
+func (a *arenaPolicy) RemoveOldest() (string, Value, bool) {
+	key, b, ok := a.c.RemoveOldest()
+	return key, decodeArenaValue(b), ok
+}
+
+func (a *arenaPolicy) RemoveExpired(now time.Time, limit int) int {
+	return a.c.RemoveExpired(now, limit)
+}
+
+func (a *arenaPolicy) Len() int {
+	return a.c.Len()
+}
+
+func (a *arenaPolicy) Bytes() int64 {
+	return a.c.Bytes()
+}
+
+//bytes of entries do not depend on Size, nothing to recount
+func (a *arenaPolicy) Recount() {}
+
+func (a *arenaPolicy) Clear() {
+	a.c.Clear()
+}
+
+func (a *arenaPolicy) Configure(cfg lru.Config[string, Value]) {
+	a.c.Sliding = cfg.Sliding
+	a.c.MaxLifetime = cfg.MaxLifetime
+	a.c.OnDroped = nil
+	if cfg.OnDroped != nil {
+		a.c.OnDroped = func(key string, val []byte) {
+			cfg.OnDroped(key, decodeArenaValue(append([]byte(nil), val...)))
+		}
+	}
+	a.c.OnEvicted = nil
+	if cfg.OnEvicted != nil {
+		a.c.OnEvicted = func(key string, val []byte, expireAt time.Time) {
+			cfg.OnEvicted(lru.Item[string, Value]{
+				Key:      key,
+				Val:      decodeArenaValue(append([]byte(nil), val...)),
+				ExpireAt: expireAt,
+			})
+		}
+	}
+}
+
+//bytes of val as kept in arena: a header, then value. header is Compression
+//in one byte, whether checksum is valid in one byte, checksum in four bytes,
+//version in eight bytes, then length of key id in one byte and key id
+func encodeArenaValue(val Value) []byte {
+	size := arenaHeaderSize + len(val.keyID)
+	b := make([]byte, size, size+val.Len())
+	b[0] = byte(val.codec)
+	if val.summed {
+		b[1] = 1
+		binary.LittleEndian.PutUint32(b[2:], val.sum)
+	}
+	binary.LittleEndian.PutUint64(b[6:], val.version)
+	b[14] = byte(len(val.keyID))
+	copy(b[arenaHeaderSize:], val.keyID)
+	return val.AppendTo(b)
+}
+
+//reverse of encodeArenaValue, b is owned by the returned Value
+func decodeArenaValue(b []byte) Value {
+	if len(b) < arenaHeaderSize || len(b) < arenaHeaderSize+int(b[14]) {
+		return Value{}
+	}
+	size := arenaHeaderSize + int(b[14])
+	return Value{
+		b:       b[size:],
+		codec:   Compression(b[0]),
+		sum:     binary.LittleEndian.Uint32(b[2:]),
+		summed:  b[1] == 1,
+		keyID:   string(b[arenaHeaderSize:size]),
+		version: binary.LittleEndian.Uint64(b[6:]),
+	}
+}
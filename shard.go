@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/lru"
+)
+
+//one shard of cache, with its own lock and eviction policy. the byte budget
+//is kept by cache for all shards together
+type shard struct {
+	rw           sync.RWMutex
+	policy       Policy         //LRU cache by default, counts bytes of every entry
+	kind         EvictionPolicy //policy created on lazy initialization
+	capacity     int64          //share of byte budget of cache, sizes policy, 0 means no limit
+	overhead     int64          //bytes counted for each entry besides its key and value
+	ngets, nhits int64
+	nevicts      int64 //entries evicted for exceeding budget
+
+	//bytes of policy, written with lock held and read atomically without it
+	used int64
+
+	//bytes of all shards of cache, accessed atomically
+	total *int64
+
+	//sliding expiration config, see lru.Config
+	sliding     bool
+	maxLifetime time.Duration
+
+	//called with entries evicted for exceeding budget, lock is held
+	onEvict func(item lru.Item[string, Value])
+
+	closed bool
+}
+
+//lazy initialization of policy, lock must be held
+func (s *shard) lazyInit() {
+	if s.policy != nil {
+		return
+	}
+	s.policy = newPolicy(s.kind, s.capacity)
+	s.configure()
+}
+
+//pass config to policy, lock must be held
+func (s *shard) configure() {
+	s.policy.Configure(lru.Config[string, Value]{
+		Size:        s.entryBytes,
+		Sliding:     s.sliding,
+		MaxLifetime: s.maxLifetime,
+		OnEvicted:   s.onEvict,
+	})
+}
+
+//bytes counted for an entry
+func (s *shard) entryBytes(key string, val Value) int64 {
+	return int64(len(key)) + int64(val.Len()) + s.overhead
+}
+
+//mirror bytes of policy into used and total after a change, lock must be held
+func (s *shard) account() {
+	var n int64
+	if s.policy != nil {
+		n = s.policy.Bytes()
+	}
+	if d := n - s.used; d != 0 {
+		atomic.StoreInt64(&s.used, n)
+		if s.total != nil {
+			atomic.AddInt64(s.total, d)
+		}
+	}
+}
+
+//add cache, nothing happens if shard is closed. the budget is enforced by
+//cache
+func (s *shard) add(key string, val Value, ttl time.Duration) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.closed {
+		return
+	}
+	s.lazyInit()
+	s.policy.Add(key, val, ttl)
+}
+
+//add cache unless check is set and version of the entry of key is not
+//expected, 0 standing for no entry. val takes a version larger than the one
+//it replaces, so versions of a key only go up. return version of the entry
+//after the call and whether val is added
+func (s *shard) addVersioned(key string, val Value, ttl time.Duration, expected uint64, check bool) (uint64, bool) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.closed {
+		return 0, false
+	}
+	s.lazyInit()
+	var cur uint64
+	if item, ok := s.policy.Peek(key); ok {
+		cur = item.Val.version
+	}
+	if check && cur != expected {
+		return cur, false
+	}
+	if val.version <= cur {
+		val.version = cur + 1
+	}
+	s.policy.Add(key, val, ttl)
+	return val.version, true
+}
+
+//get cache
+func (s *shard) get(key string) (value Value, ok bool) {
+	//policies update recency or frequency on hit, so even get takes the write
+	//lock
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.policy == nil {
+		return
+	}
+	s.ngets++
+	//expired cache is deleted by policy
+	value, ok = s.policy.Get(key)
+	if ok {
+		s.nhits++
+	}
+	return
+}
+
+//get cache with its expiration, without counting as an access
+func (s *shard) peek(key string) (item lru.Item[string, Value], ok bool) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	if s.policy == nil {
+		return
+	}
+	return s.policy.Peek(key)
+}
+
+//append entries not expired to items and return it, values are shared
+func (s *shard) items(items []lru.Item[string, Value]) []lru.Item[string, Value] {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	if s.policy == nil {
+		return items
+	}
+	s.policy.Range(func(item lru.Item[string, Value]) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+//del cache
+func (s *shard) del(key string) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.policy == nil {
+		return
+	}
+	s.policy.Del(key)
+}
+
+//evict one cache chosen by policy, return bytes freed. return false if
+//shard is empty
+func (s *shard) removeLeastUsed() (int64, bool) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.policy == nil {
+		return 0, false
+	}
+	before := s.policy.Bytes()
+	if _, _, ok := s.policy.RemoveOldest(); !ok {
+		return 0, false
+	}
+	s.nevicts++
+	return before - s.policy.Bytes(), true
+}
+
+//remove at most [delCount] cache expired at the moment now
+func (s *shard) removeExpired(now time.Time) int {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.policy == nil {
+		return 0
+	}
+	return s.policy.RemoveExpired(now, delCount)
+}
+
+//return memory usage of shard, without locking
+func (s *shard) bytes() int64 {
+	return atomic.LoadInt64(&s.used)
+}
+
+//return number of entries in shard
+func (s *shard) len() int {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	if s.policy == nil {
+		return 0
+	}
+	return s.policy.Len()
+}
+
+//set share of byte budget, an arena is resized at once and other policies
+//are sized by it once created
+func (s *shard) setCapacity(capacity int64) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	s.capacity = capacity
+	if p, ok := s.policy.(*arenaPolicy); ok {
+		p.setCapacity(capacity)
+	}
+}
+
+//set bytes counted for each entry besides its key and value. entries already
+//in shard are recounted
+func (s *shard) setOverhead(overhead int64) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	s.overhead = overhead
+	if s.policy != nil {
+		s.policy.Recount()
+	}
+}
+
+//switch to sliding expiration, see cache.setSliding
+func (s *shard) setSliding(maxLifetime time.Duration) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.sliding = true
+	s.maxLifetime = maxLifetime
+	if s.policy != nil {
+		s.configure()
+	}
+}
+
+//set callback of evicted entries, see cache.setOnEvict
+func (s *shard) setOnEvict(f func(item lru.Item[string, Value])) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.onEvict = f
+	if s.policy != nil {
+		s.configure()
+	}
+}
+
+//drop all cache and refuse further add
+func (s *shard) close() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	s.closed = true
+	if s.policy != nil {
+		s.policy.Clear()
+	}
+}
+
+//drop all cache
+func (s *shard) clear() {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	if s.policy != nil {
+		s.policy.Clear()
+	}
+}
+
+//switch eviction policy, cache already in shard is dropped
+func (s *shard) setPolicy(kind EvictionPolicy) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	defer s.account()
+	s.kind = kind
+	if s.policy != nil {
+		s.policy.Clear()
+		s.policy = nil
+	}
+}
@@ -1,9 +1,16 @@
 package singleshot
 
 import (
+	"errors"
 	"sync"
 )
 
+//returned by Do once Shots is closed
+var ErrClosed = errors.New("singleshot: closed")
+
+//returned to callers sharing a call whose fn panicked
+var errPanicked = errors.New("singleshot: fn panicked")
+
 type call struct {
 	wg  sync.WaitGroup
 	val interface{} //函数返回值，一个空interface以及一个error
@@ -14,10 +21,18 @@ type call struct {
 type Shots struct {
 	mu  sync.Mutex
 	dic map[string]*call
+
+	//in-flight calls, drained by Close
+	wg     sync.WaitGroup
+	closed bool
 }
 
 func (s *Shots) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
 	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
 	//延迟初始化
 	if s.dic == nil {
 		s.dic = make(map[string]*call)
@@ -34,16 +49,28 @@ func (s *Shots) Do(key string, fn func() (interface{}, error)) (interface{}, err
 	c := &call{}
 	c.wg.Add(1)
 	s.dic[key] = c
+	s.wg.Add(1)
 	s.mu.Unlock()
 
-	//调用fn函数
+	//fn panic时也要唤醒等待者并删除key-call，否则Close会一直阻塞
+	defer func() {
+		c.wg.Done()
+		s.mu.Lock()
+		delete(s.dic, key)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	//调用fn函数，fn panic时等待者得到errPanicked
+	c.err = errPanicked
 	c.val, c.err = fn()
-	c.wg.Done()
+	return c.val, c.err
+}
 
-	//删除key-call
+//拒绝新的调用，并阻塞至所有进行中的调用结束
+func (s *Shots) Close() {
 	s.mu.Lock()
-	delete(s.dic, key)
+	s.closed = true
 	s.mu.Unlock()
-
-	return c.val, c.err
+	s.wg.Wait()
 }
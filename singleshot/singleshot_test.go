@@ -37,3 +37,30 @@ func TestDo(t *testing.T) {
 		t.Errorf("got %v but want %v", got, 1)
 	}
 }
+
+func TestDoPanic(t *testing.T) {
+	shots := Shots{}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("panic not propagated")
+			}
+		}()
+		shots.Do("key", func() (interface{}, error) { panic("boom") })
+	}()
+
+	//the panicked call is gone
+	if v, err := shots.Do("key", func() (interface{}, error) { return "done", nil }); v != "done" || err != nil {
+		t.Errorf("got %v, %v", v, err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		shots.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("Close blocked by a panicked call")
+	}
+}
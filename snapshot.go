@@ -0,0 +1,447 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/lru"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//snapshot format:
+//	magic "DCSNAP" | version uint16 | record... | end record
+//a record is
+//	tier uint8 | expireAt int64 | codec uint8 | summed uint8 | checksum uint32 |
+//	len(keyID) uint8 | keyID | version uvarint | len(key) uvarint | key |
+//	len(value) uvarint | value | crc32c of the record uint32
+//tier is endOfSnapshot for the end record, which only has a count of records
+//as uvarint and its crc32c. integers are big endian. values are written as
+//stored, so compressed and encrypted values stay so on disk. version 1 has no
+//version of value in records
+const (
+	snapshotMagic   = "DCSNAP"
+	snapshotVersion = 2
+
+	tierMain      = 0
+	tierHot       = 1
+	endOfSnapshot = 0xff
+
+	//largest key or value accepted on restore
+	maxSnapshotField = 1 << 30
+)
+
+//snapshot is not in a known format or is corrupted
+var ErrBadSnapshot = errors.New("dcache: bad snapshot")
+
+//writes records of a snapshot
+type snapshotWriter struct {
+	w     *bufio.Writer
+	buf   []byte //header of current record
+	count uint64
+}
+
+func newSnapshotWriter(w io.Writer) (*snapshotWriter, error) {
+	s := &snapshotWriter{w: bufio.NewWriter(w)}
+	s.buf = append(s.buf, snapshotMagic...)
+	s.buf = binary.BigEndian.AppendUint16(s.buf, snapshotVersion)
+	_, err := s.w.Write(s.buf)
+	return s, err
+}
+
+//write an entry of tier
+func (s *snapshotWriter) write(tier byte, item lru.Item[string, Value]) error {
+	val := item.Val
+	b := append(s.buf[:0], tier)
+	b = binary.BigEndian.AppendUint64(b, uint64(item.ExpireAt.UnixNano()))
+	b = append(b, byte(val.codec))
+	if val.summed {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.BigEndian.AppendUint32(b, val.sum)
+	b = append(b, byte(len(val.keyID)))
+	b = append(b, val.keyID...)
+	b = binary.AppendUvarint(b, val.version)
+	b = binary.AppendUvarint(b, uint64(len(item.Key)))
+	b = append(b, item.Key...)
+	b = binary.AppendUvarint(b, uint64(val.Len()))
+	s.buf = b
+
+	//value is written as is, never copied into the record buffer
+	sum := crc32.Checksum(b, crcTable)
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	err := val.eachChunk(ChunkSize, func(chunk []byte) error {
+		sum = crc32.Update(sum, crcTable, chunk)
+		_, err := s.w.Write(chunk)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.count++
+	_, err = s.w.Write(binary.BigEndian.AppendUint32(s.buf[:0], sum))
+	return err
+}
+
+//write the end record and flush
+func (s *snapshotWriter) close() error {
+	b := append(s.buf[:0], endOfSnapshot)
+	b = binary.AppendUvarint(b, s.count)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+//reads records of a snapshot, every record is verified before handed out
+type snapshotReader struct {
+	r       *bufio.Reader
+	crc     uint32 //crc32c of current record so far
+	version uint16 //format version
+}
+
+func newSnapshotReader(r io.Reader) (*snapshotReader, error) {
+	s := &snapshotReader{r: bufio.NewReader(r)}
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	}
+	s.version = binary.BigEndian.Uint16(header[len(snapshotMagic):])
+	if s.version < 1 || s.version > snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, s.version)
+	}
+	return s, nil
+}
+
+//implements io.ByteReader for binary.ReadUvarint, updating crc
+func (s *snapshotReader) ReadByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == nil {
+		s.crc = crc32.Update(s.crc, crcTable, []byte{c})
+	}
+	return c, err
+}
+
+//read exactly len(b) bytes, updating crc
+func (s *snapshotReader) readFull(b []byte) error {
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return err
+	}
+	s.crc = crc32.Update(s.crc, crcTable, b)
+	return nil
+}
+
+//read a uvarint no larger than max
+func (s *snapshotReader) readLen(max uint64) (int, error) {
+	n, err := binary.ReadUvarint(s)
+	if err == nil && n > max {
+		err = fmt.Errorf("field of %d bytes", n)
+	}
+	return int(n), err
+}
+
+//read the next record, return io.EOF after the end record
+func (s *snapshotReader) next() (tier byte, item lru.Item[string, Value], err error) {
+	defer func() {
+		if err != nil && err != io.EOF {
+			err = fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+		}
+	}()
+	s.crc = 0
+	if tier, err = s.ReadByte(); err != nil {
+		return
+	}
+	if tier == endOfSnapshot {
+		if _, err = binary.ReadUvarint(s); err != nil {
+			return
+		}
+		err = s.checkCRC()
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	}
+
+	var fixed [8 + 1 + 1 + 4 + 1]byte
+	if err = s.readFull(fixed[:]); err != nil {
+		return
+	}
+	item.ExpireAt = time.Unix(0, int64(binary.BigEndian.Uint64(fixed[:8])))
+	item.Val.codec = Compression(fixed[8])
+	item.Val.summed = fixed[9] == 1
+	item.Val.sum = binary.BigEndian.Uint32(fixed[10:14])
+	keyID := make([]byte, fixed[14])
+	if err = s.readFull(keyID); err != nil {
+		return
+	}
+	item.Val.keyID = string(keyID)
+	if s.version >= 2 {
+		if item.Val.version, err = binary.ReadUvarint(s); err != nil {
+			return
+		}
+	}
+
+	n, err := s.readLen(maxSnapshotField)
+	if err != nil {
+		return
+	}
+	key := make([]byte, n)
+	if err = s.readFull(key); err != nil {
+		return
+	}
+	item.Key = string(key)
+	if n, err = s.readLen(maxSnapshotField); err != nil {
+		return
+	}
+	//large values are read in chunks, as from peers
+	for n > 0 {
+		size := n
+		if size > ChunkSize {
+			size = ChunkSize
+		}
+		chunk := make([]byte, size)
+		if err = s.readFull(chunk); err != nil {
+			return
+		}
+		item.Val.chunks = append(item.Val.chunks, chunk)
+		n -= size
+	}
+	if len(item.Val.chunks) <= 1 {
+		if len(item.Val.chunks) == 1 {
+			item.Val.b = item.Val.chunks[0]
+		}
+		item.Val.chunks = nil
+	}
+	err = s.checkCRC()
+	return
+}
+
+//read crc32c at the end of a record and compare it with the record
+func (s *snapshotReader) checkCRC() error {
+	want := s.crc
+	var b [4]byte
+	if _, err := io.ReadFull(s.r, b[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(b[:]) != want {
+		return ErrChecksum
+	}
+	return nil
+}
+
+//write entries of every shard as tier. a shard is locked only while copying
+//out its entry headers, values are shared, so a snapshot takes memory of the
+//largest shard's headers at most
+func (c *cache) snapshot(s *snapshotWriter, tier byte) error {
+	var items []lru.Item[string, Value]
+	for _, sh := range c.shards {
+		items = sh.items(items[:0])
+		for i := range items {
+			if err := s.write(tier, items[i]); err != nil {
+				return err
+			}
+			items[i] = lru.Item[string, Value]{}
+		}
+	}
+	return nil
+}
+
+//write all entries not expired to w in snapshot format, return number of
+//entries written. concurrency safe
+func (c *cache) Snapshot(w io.Writer) (int, error) {
+	s, err := newSnapshotWriter(w)
+	if err == nil {
+		err = c.snapshot(s, tierMain)
+	}
+	if err == nil {
+		err = s.close()
+	}
+	return int(s.count), err
+}
+
+//add entries of a snapshot written by Snapshot with their remaining TTL,
+//expired entries are skipped. return number of entries restored. entries
+//before a corrupted record are kept. concurrency safe
+func (c *cache) Restore(r io.Reader) (int, error) {
+	return restore(r, func(tier byte, item lru.Item[string, Value], ttl time.Duration) {
+		c.add(item.Key, item.Val, ttl)
+	})
+}
+
+//read a snapshot and call add on every entry not expired and matching its
+//checksum, return number of such entries
+func restore(r io.Reader, add func(tier byte, item lru.Item[string, Value], ttl time.Duration)) (int, error) {
+	s, err := newSnapshotReader(r)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for {
+		tier, item, err := s.next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		ttl := time.Until(item.ExpireAt)
+		if ttl <= 0 || !verify(&item.Val) {
+			continue
+		}
+		add(tier, item, ttl)
+		count++
+	}
+}
+
+//write entries of mainCache and hotCache to w, see cache.Snapshot. values
+//are written as stored, so encrypted values stay encrypted
+func (g *GroupCache) Snapshot(w io.Writer) (int, error) {
+	s, err := newSnapshotWriter(w)
+	if err == nil {
+		err = g.mainCache.snapshot(s, tierMain)
+	}
+	if err == nil {
+		err = g.hotCache.snapshot(s, tierHot)
+	}
+	if err == nil {
+		err = s.close()
+	}
+	return int(s.count), err
+}
+
+//restore entries of a snapshot written by Snapshot into the tier they were
+//taken from, see cache.Restore. call it before the GroupCache is used, say on
+//startup, so that the node does not start cold
+func (g *GroupCache) Restore(r io.Reader) (int, error) {
+	n, err := restore(r, func(tier byte, item lru.Item[string, Value], ttl time.Duration) {
+		if tier == tierHot {
+			g.hotCache.add(item.Key, item.Val, ttl)
+		} else {
+			g.mainCache.add(item.Key, item.Val, ttl)
+			g.dropFromDisk(item.Key)
+		}
+		g.checkOverflow()
+	})
+	logger.GetInstance().WithFields(logrus.Fields{
+		"group":    g.name,
+		"restored": n,
+		"err":      err,
+	}).Infoln("restore snapshot")
+	return n, err
+}
+
+//write a snapshot to file path. it is written to a temporary file first and
+//renamed, so path always holds a complete snapshot
+func (g *GroupCache) SnapshotToFile(path string) (int, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	n, err := g.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	return n, err
+}
+
+//restore from a snapshot file written by SnapshotToFile. a missing file is
+//not an error, nothing is restored then
+func (g *GroupCache) RestoreFromFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return g.Restore(f)
+}
+
+//write a snapshot to path every interval and once more on Close, so that a
+//restarted node can RestoreFromFile. interval <= 0 only snapshots on Close.
+//calling it again replaces the schedule
+func (g *GroupCache) EnablePeriodicSnapshot(path string, interval time.Duration) {
+	g.snapMu.Lock()
+	defer g.snapMu.Unlock()
+	if g.snapStop != nil {
+		close(g.snapStop)
+		g.snapStop = nil
+	}
+	g.snapPath = path
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	g.snapStop = stop
+	g.snapWg.Add(1)
+	go func() {
+		defer g.snapWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.periodicSnapshot(path)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+//take a scheduled snapshot and log the result
+func (g *GroupCache) periodicSnapshot(path string) {
+	n, err := g.SnapshotToFile(path)
+	if err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"path":  path,
+			"err":   err,
+		}).Errorln("snapshot failed")
+		return
+	}
+	logger.GetInstance().WithFields(logrus.Fields{
+		"group":   g.name,
+		"path":    path,
+		"entries": n,
+	}).Infoln("snapshot succ")
+}
+
+//stop periodic snapshot and take the final one, called by Close
+func (g *GroupCache) stopSnapshot() {
+	g.snapMu.Lock()
+	if g.snapStop != nil {
+		close(g.snapStop)
+		g.snapStop = nil
+	}
+	path := g.snapPath
+	g.snapPath = ""
+	g.snapMu.Unlock()
+	g.snapWg.Wait()
+	if path != "" {
+		g.periodicSnapshot(path)
+	}
+}
@@ -0,0 +1,120 @@
+package cache
+
+import "sync/atomic"
+
+//statistics of a GroupCache, see GroupCache.Stats
+type Stats struct {
+	Gets        int64 //calls of Get
+	LocalHits   int64 //Get served by mainCache or hotCache
+	PeerLoads   int64 //values loaded from peers
+	GetterLoads int64 //values loaded from Getter
+	LoadErrors  int64 //failed loads
+
+	//admission decisions of hotCache on Gets of keys owned by peers
+	HotAdmitted int64
+	HotRejected int64
+
+	//hot key replication, see GroupCache.EnableHotKeyReplication
+	HotPushes     int64 //hot keys pushed to peers, counted per peer
+	HotPushErrors int64 //failed pushes
+	HotReceived   int64 //hot keys pushed by owners and written to hotCache
+
+	//values failing their checksum: responses of peers rejected and entries
+	//dropped on read, see SetVerifyOnRead
+	ChecksumErrors int64
+
+	//Get served by the disk tier, see GroupCache.EnableDiskTier
+	DiskHits int64
+
+	//writes to the backing store, see GroupCache.Set
+	Writes        int64 //calls of Set and Delete
+	WritesFlushed int64 //writes flushed by write-behind
+	WriteErrors   int64 //failed write-behind batches
+
+	//leases on keys missing in cache, see GroupCache.GetWithLease
+	LeasesGranted int64 //leases handed out
+	LeaseWaits    int64 //clients told to wait for another holder
+	LeaseRejects  int64 //SetWithLease refused as the lease was void
+
+	MainCache CacheStats
+	HotCache  CacheStats
+	DiskCache CacheStats //zero if disk tier is not enabled
+}
+
+//statistics of mainCache or hotCache
+type CacheStats struct {
+	Items     int64 //number of entries
+	Bytes     int64 //memory usage, counted as key + value + overhead of every entry
+	MaxBytes  int64 //byte budget, 0 means no limit
+	Gets      int64 //lookups
+	Hits      int64 //lookups that hit
+	Evictions int64 //entries evicted for exceeding byte budget
+}
+
+//counters of a GroupCache, updated atomically
+type groupStats struct {
+	gets, localHits, peerLoads, getterLoads, loadErrors int64
+	hotAdmitted, hotRejected                            int64
+	hotPushes, hotPushErrors, hotReceived               int64
+	checksumErrors, diskHits                            int64
+	writes, writesFlushed, writeErrors                  int64
+	leasesGranted, leaseWaits, leaseRejects             int64
+}
+
+//increase counter by 1
+func inc(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+
+//return statistics of GroupCache, concurrency safe
+func (g *GroupCache) Stats() Stats {
+	var diskStats CacheStats
+	if g.disk != nil {
+		diskStats = g.disk.stats()
+	}
+	return Stats{
+		Gets:        atomic.LoadInt64(&g.stats.gets),
+		LocalHits:   atomic.LoadInt64(&g.stats.localHits),
+		PeerLoads:   atomic.LoadInt64(&g.stats.peerLoads),
+		GetterLoads: atomic.LoadInt64(&g.stats.getterLoads),
+		LoadErrors:  atomic.LoadInt64(&g.stats.loadErrors),
+		HotAdmitted: atomic.LoadInt64(&g.stats.hotAdmitted),
+		HotRejected: atomic.LoadInt64(&g.stats.hotRejected),
+
+		HotPushes:     atomic.LoadInt64(&g.stats.hotPushes),
+		HotPushErrors: atomic.LoadInt64(&g.stats.hotPushErrors),
+		HotReceived:   atomic.LoadInt64(&g.stats.hotReceived),
+
+		ChecksumErrors: atomic.LoadInt64(&g.stats.checksumErrors),
+		DiskHits:       atomic.LoadInt64(&g.stats.diskHits),
+
+		Writes:        atomic.LoadInt64(&g.stats.writes),
+		WritesFlushed: atomic.LoadInt64(&g.stats.writesFlushed),
+		WriteErrors:   atomic.LoadInt64(&g.stats.writeErrors),
+
+		LeasesGranted: atomic.LoadInt64(&g.stats.leasesGranted),
+		LeaseWaits:    atomic.LoadInt64(&g.stats.leaseWaits),
+		LeaseRejects:  atomic.LoadInt64(&g.stats.leaseRejects),
+
+		MainCache: g.mainCache.stats(),
+		HotCache:  g.hotCache.stats(),
+		DiskCache: diskStats,
+	}
+}
+
+//return statistics of cache, concurrency safe
+func (c *cache) stats() CacheStats {
+	res := CacheStats{MaxBytes: atomic.LoadInt64(&c.maxBytes)}
+	for _, s := range c.shards {
+		s.rw.RLock()
+		if s.policy != nil {
+			res.Items += int64(s.policy.Len())
+			res.Bytes += s.policy.Bytes()
+		}
+		res.Gets += s.ngets
+		res.Hits += s.nhits
+		res.Evictions += s.nevicts
+		s.rw.RUnlock()
+	}
+	return res
+}
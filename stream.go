@@ -0,0 +1,303 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//a large value is transferred between peers as a stream of frames:
+//	length uint32 | crc32c of data uint32 | data
+//each frame carries at most ChunkSize bytes. the stream ends with a frame of
+//length 0 whose checksum is the crc32c of the whole value, so that a truncated
+//stream is never taken as a complete value
+const (
+	//size of a chunk of a large value, in storage and on the wire
+	ChunkSize = 64 << 10
+
+	//values larger than ChunkThreshold are streamed by peers instead of sent
+	//in one protobuf message, and kept in chunks
+	ChunkThreshold = 1 << 20
+
+	frameHeaderSize = 8
+
+	//response header telling the body is a stream of frames
+	streamHeader = "X-Dcache-Stream"
+
+	//response header carrying Compression of a streamed value
+	compressionHeader = "X-Dcache-Compression"
+
+	//response header carrying checksum of a streamed value as stored
+	checksumHeader = "X-Dcache-Checksum"
+
+	//response header carrying version of a streamed value
+	versionHeader = "X-Dcache-Version"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//checksum of a frame does not match its data
+var ErrChecksum = errors.New("dcache: checksum mismatch")
+
+//write val to w as a stream of frames
+func writeStream(w io.Writer, val Value) error {
+	var header [frameHeaderSize]byte
+	var total uint32
+	err := val.eachChunk(ChunkSize, func(chunk []byte) error {
+		sum := crc32.Checksum(chunk, crcTable)
+		total = crc32.Update(total, crcTable, chunk)
+		binary.BigEndian.PutUint32(header[:4], uint32(len(chunk)))
+		binary.BigEndian.PutUint32(header[4:], sum)
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(chunk)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(header[:4], 0)
+	binary.BigEndian.PutUint32(header[4:], total)
+	_, err = w.Write(header[:])
+	return err
+}
+
+//decode a stream of frames, every chunk is verified before handed out
+type frameReader struct {
+	r     io.ReadCloser
+	chunk []byte //unread part of current chunk
+	total uint32 //crc32c of all chunks read
+	err   error  //sticky error, io.EOF once the end frame is verified
+}
+
+func newFrameReader(r io.ReadCloser) *frameReader {
+	return &frameReader{r: r}
+}
+
+//read and verify the next chunk, return io.EOF after the end frame. the
+//returned slice is newly allocated and owned by the caller
+func (f *frameReader) next() ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		return nil, f.fail(err)
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+	if n == 0 {
+		if sum != f.total {
+			return nil, f.fail(ErrChecksum)
+		}
+		f.err = io.EOF
+		return nil, io.EOF
+	}
+	if n > ChunkSize {
+		return nil, f.fail(fmt.Errorf("dcache: frame of %d bytes exceeds chunk size", n))
+	}
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(f.r, chunk); err != nil {
+		return nil, f.fail(err)
+	}
+	if crc32.Checksum(chunk, crcTable) != sum {
+		return nil, f.fail(ErrChecksum)
+	}
+	f.total = crc32.Update(f.total, crcTable, chunk)
+	return chunk, nil
+}
+
+//record a sticky error, a stream ending without the end frame is truncated
+func (f *frameReader) fail(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	f.err = err
+	return err
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.chunk) == 0 {
+		chunk, err := f.next()
+		if err != nil {
+			return 0, err
+		}
+		f.chunk = chunk
+	}
+	n := copy(p, f.chunk)
+	f.chunk = f.chunk[n:]
+	return n, nil
+}
+
+func (f *frameReader) Close() error {
+	return f.r.Close()
+}
+
+//read a whole value from r, large values are kept in chunks as read so that
+//they are never copied into one growing buffer
+func readValue(r io.Reader) (Value, error) {
+	if f, ok := r.(*frameReader); ok {
+		var chunks [][]byte
+		for {
+			chunk, err := f.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return Value{}, err
+			}
+			chunks = append(chunks, chunk)
+		}
+		switch len(chunks) {
+		case 0:
+			return Value{}, nil
+		case 1:
+			return Value{b: chunks[0]}, nil
+		}
+		return Value{chunks: chunks}, nil
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{b: b}, nil
+}
+
+//write val as the response of a streaming request: a stream of frames if val
+//is larger than ChunkThreshold, or else an encoded pb.GetResponse
+func writeValue(w http.ResponseWriter, val Value) error {
+	if val.Len() <= ChunkThreshold {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		return writeGetResponse(w, val)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(streamHeader, "1")
+	w.Header().Set(compressionHeader, strconv.Itoa(int(val.codec)))
+	if val.summed {
+		w.Header().Set(checksumHeader, strconv.FormatUint(uint64(val.sum), 10))
+	}
+	if val.version != 0 {
+		w.Header().Set(versionHeader, strconv.FormatUint(val.version, 10))
+	}
+	return writeStream(w, val)
+}
+
+//open a stream of key from peer for GetReader. a large uncompressed value is
+//handed out as it arrives, anything else is read as a whole first
+func (g *GroupCache) streamFromPeer(peer StreamPeer, addr string, key string, ttl time.Duration, admit bool) (io.ReadCloser, error) {
+	resp := &pb.GetResponse{}
+	rc, err := peer.GetStream(&pb.GetRequest{Group: g.name, Key: key}, resp)
+	if err != nil {
+		return nil, g.peerStreamFailed(addr, key, err)
+	}
+	resp.Value = nil
+	meta := valueOf(resp)
+	f, ok := rc.(*frameReader)
+	if ok && meta.codec == CompressionNone {
+		return &peerStream{g: g, addr: addr, key: key, ttl: ttl, admit: admit, f: f, meta: meta}, nil
+	}
+
+	val, err := readValue(rc)
+	rc.Close()
+	val.codec, val.sum, val.summed, val.version = meta.codec, meta.sum, meta.summed, meta.version
+	if err == nil && !verifyPeer(&val) {
+		g.corrupted(key, addr)
+		err = ErrChecksum
+	}
+	if err != nil {
+		return nil, g.peerStreamFailed(addr, key, err)
+	}
+	inc(&g.stats.peerLoads)
+	if admit {
+		g.populateHotCache(key, val, ttl)
+	}
+	if val, err = decompressValue(val); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(val.Reader()), nil
+}
+
+//count and log a failed stream from peer, return the error for the caller
+func (g *GroupCache) peerStreamFailed(addr string, key string, err error) error {
+	inc(&g.stats.loadErrors)
+	logger.GetInstance().WithFields(logrus.Fields{
+		"group": g.name,
+		"key":   key,
+		"peer":  addr,
+		"err":   err,
+	}).Errorln("stream cache from peer failed")
+	return fmt.Errorf("stream cache from peer [%v] failed: %v", addr, err)
+}
+
+//reader of a value streamed from peer. chunks are handed out as they arrive
+//and kept, the whole value goes to hotCache if admitted once the end frame
+//and the checksum of the value are verified
+type peerStream struct {
+	g     *GroupCache
+	addr  string
+	key   string
+	ttl   time.Duration
+	admit bool
+
+	f      *frameReader
+	meta   Value    //metadata of value sent before the stream
+	chunks [][]byte //chunks read so far
+	chunk  []byte   //unread part of current chunk
+	sum    uint32   //crc32c of chunks read
+	err    error    //sticky error, io.EOF once the value is complete
+}
+
+func (s *peerStream) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		chunk, err := s.f.next()
+		if err != nil {
+			s.finish(err)
+			continue
+		}
+		s.chunks = append(s.chunks, chunk)
+		s.sum = crc32.Update(s.sum, crcTable, chunk)
+		s.chunk = chunk
+	}
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	return n, nil
+}
+
+//end the stream with err, io.EOF if all frames are read
+func (s *peerStream) finish(err error) {
+	if err == io.EOF && (!s.meta.summed || s.sum != s.meta.sum) {
+		s.g.corrupted(s.key, s.addr)
+		err = ErrChecksum
+	}
+	s.err = err
+	if err != io.EOF {
+		s.g.peerStreamFailed(s.addr, s.key, err)
+		return
+	}
+	inc(&s.g.stats.peerLoads)
+	if s.admit {
+		val := s.meta
+		val.chunks = s.chunks
+		s.g.populateHotCache(s.key, val, s.ttl)
+	}
+	s.chunks = nil
+}
+
+func (s *peerStream) Close() error {
+	s.chunks = nil
+	return s.f.Close()
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/lru"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+//converts objects of type T from and to bytes stored in GroupCache
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(b []byte) (T, error)
+}
+
+//encoding/json codec
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+//encoding/gob codec. every value carries its own type description, so it is
+//larger than the others for small objects
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+//protobuf codec, T is a pointer to a generated message like *pb.GetRequest
+type ProtoCodec[T proto.Message] struct{}
+
+func (ProtoCodec[T]) Marshal(v T) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (ProtoCodec[T]) Unmarshal(b []byte) (T, error) {
+	var zero T
+	//a nil message pointer still reflects its type
+	v := zero.ProtoReflect().Type().New().Interface().(T)
+	err := proto.Unmarshal(b, v)
+	return v, err
+}
+
+//msgpack codec
+type MsgpackCodec[T any] struct{}
+
+func (MsgpackCodec[T]) Marshal(v T) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	err := msgpack.Unmarshal(b, &v)
+	return v, err
+}
+
+//a GroupCache of objects of type T. objects are encoded by a Codec before they
+//are stored, so everything else works as for bytes: peers, compression,
+//eviction. decoded objects can be kept in an object tier as well, see
+//EnableObjectCache
+type TypedGroup[T any] struct {
+	group *GroupCache
+	codec Codec[T]
+
+	//object tier, nil if not enabled
+	mu         sync.Mutex
+	objects    *lru.Cache[string, T]
+	maxObjects int
+	objectTTL  time.Duration
+
+	//number of Add and Del, an object decoded from a value read before one of
+	//them may be stale and is not kept
+	writes uint64
+}
+
+//wrap group with codec
+func NewTypedGroup[T any](group *GroupCache, codec Codec[T]) *TypedGroup[T] {
+	return &TypedGroup[T]{group: group, codec: codec}
+}
+
+//create a GroupCache whose getter loads objects, and wrap it with codec.
+//see NewGroupCache
+func NewTypedGroupCache[T any](name string, maxBytes int64, codec Codec[T],
+	getter func(key string) (T, error)) *TypedGroup[T] {
+	var g Getter
+	if getter != nil {
+		g = GetterFunc(func(key string) ([]byte, error) {
+			v, err := getter(key)
+			if err != nil {
+				return nil, err
+			}
+			return codec.Marshal(v)
+		})
+	}
+	return NewTypedGroup(NewGroupCache(name, maxBytes, g), codec)
+}
+
+//return the underlying GroupCache
+func (t *TypedGroup[T]) Group() *GroupCache {
+	return t.group
+}
+
+//keep at most maxEntries decoded objects for at most ttl, so that hot keys are
+//not decoded on every Get. objects in this tier are shared by callers and must
+//be treated as read-only. Add and Del through TypedGroup drop the object, other
+//changes of the value, like an update on its owner peer, are seen after ttl.
+//objects are plaintext, so the tier is refused if the group encrypts values,
+//see GroupCache.SetEncryption
+func (t *TypedGroup[T]) EnableObjectCache(maxEntries int, ttl time.Duration) {
+	if t.group.encryptor.Load() != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": t.group.name,
+		}).Warnln("object cache refused since values are encrypted")
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.objects = lru.NewCache[string, T]()
+	t.maxObjects = maxEntries
+	t.objectTTL = ttl
+}
+
+//get object according to key, see GroupCache.Get. zero T is returned if value
+//is empty. the object tier is local cache, it is looked up only if
+//opt.FromLocal
+func (t *TypedGroup[T]) Get(key string, opt Option) (T, error) {
+	if opt.FromLocal {
+		if v, ok := t.getObject(key); ok {
+			return v, nil
+		}
+	}
+	var zero T
+	writes := t.writeCount()
+	val, err := t.group.Get(key, opt)
+	if err != nil || val.Len() == 0 {
+		return zero, err
+	}
+	v, err := t.codec.Unmarshal(val.bytes())
+	if err != nil {
+		return zero, err
+	}
+	t.addObject(key, v, writes)
+	return v, nil
+}
+
+//encode v and add it, see GroupCache.Add
+func (t *TypedGroup[T]) Add(key string, v T, ttl time.Duration) error {
+	b, err := t.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.group.Add(key, b, ttl)
+	t.delObject(key)
+	return nil
+}
+
+//delete object, see GroupCache.Del
+func (t *TypedGroup[T]) Del(key string) {
+	t.group.Del(key)
+	t.delObject(key)
+}
+
+func (t *TypedGroup[T]) getObject(key string) (v T, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	//encryption set after the tier was enabled
+	if t.objects == nil || t.group.encryptor.Load() != nil {
+		return v, false
+	}
+	return t.objects.Get(key)
+}
+
+//number of Add and Del so far
+func (t *TypedGroup[T]) writeCount() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writes
+}
+
+//keep object decoded from a value read when writeCount was writes, nothing
+//happens if an Add or Del came in between
+func (t *TypedGroup[T]) addObject(key string, v T, writes uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.objects == nil || t.writes != writes || t.group.encryptor.Load() != nil {
+		return
+	}
+	t.objects.Add(key, v, t.objectTTL)
+	for t.maxObjects > 0 && t.objects.Len() > t.maxObjects {
+		t.objects.RemoveOldest()
+	}
+}
+
+//drop object of key after its value is written
+func (t *TypedGroup[T]) delObject(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writes++
+	if t.objects != nil {
+		t.objects.Del(key)
+	}
+}
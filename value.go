@@ -1,23 +1,165 @@
 package cache
 
+import (
+	"bytes"
+	"io"
+)
+
 //value type of cache, it can only be []byte
 type Value struct {
 	b []byte
+
+	//a large value loaded by streaming is kept in chunks of at most ChunkSize
+	//bytes instead of one huge slice, b is nil then
+	chunks [][]byte
+
+	//algorithm value is compressed with, only values stored in cache or on
+	//the wire are compressed
+	codec Compression
+
+	//crc32c of value as stored, valid if summed. computed when value enters
+	//cache and carried to peers along with value
+	sum    uint32
+	summed bool
+
+	//id of the key value is encrypted with, empty if not encrypted
+	keyID string
+
+	//version of value, see Version
+	version uint64
 }
 
-//return len(v.b)
+//return version of value. every write of a key gives its value a larger
+//version, so that CompareAndSet can tell whether the value is still the one
+//read. 0 means unknown, say for a value not from cache
+func (v *Value) Version() uint64 {
+	return v.version
+}
+
+//return number of bytes of value
 func (v *Value) Len() int {
-	return len(v.b)
+	if v.chunks == nil {
+		return len(v.b)
+	}
+	n := 0
+	for _, c := range v.chunks {
+		n += len(c)
+	}
+	return n
 }
 
 //return as string
 func (v *Value) String() string {
-	return string(v.b)
+	if v.chunks == nil {
+		return string(v.b)
+	}
+	return string(v.ByteSlice())
 }
 
-//return a copy of v.b
+//return a copy of value
 func (v *Value) ByteSlice() []byte {
-	return copyByteSlice(v.b)
+	if v.chunks == nil {
+		return copyByteSlice(v.b)
+	}
+	return v.AppendTo(make([]byte, 0, v.Len()))
+}
+
+//write value to w without copying it, implements io.WriterTo
+func (v *Value) WriteTo(w io.Writer) (int64, error) {
+	if v.chunks == nil {
+		n, err := w.Write(v.b)
+		return int64(n), err
+	}
+	var total int64
+	for _, c := range v.chunks {
+		n, err := w.Write(c)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+//return a read-only reader of value, no copy is made
+func (v *Value) Reader() io.Reader {
+	if v.chunks == nil {
+		return bytes.NewReader(v.b)
+	}
+	readers := make([]io.Reader, len(v.chunks))
+	for i, c := range v.chunks {
+		readers[i] = bytes.NewReader(c)
+	}
+	return io.MultiReader(readers...)
+}
+
+//copy value into dst, return number of bytes copied, which is the minimum of
+//len(dst) and v.Len()
+func (v *Value) CopyTo(dst []byte) int {
+	if v.chunks == nil {
+		return copy(dst, v.b)
+	}
+	n := 0
+	for _, c := range v.chunks {
+		n += copy(dst[n:], c)
+	}
+	return n
+}
+
+//append value to dst and return the extended slice, like append
+func (v *Value) AppendTo(dst []byte) []byte {
+	if v.chunks == nil {
+		return append(dst, v.b...)
+	}
+	for _, c := range v.chunks {
+		dst = append(dst, c...)
+	}
+	return dst
+}
+
+//value of b, split into chunks of ChunkSize if larger than ChunkThreshold so
+//that it is kept like a value streamed from peer. chunks refer to b
+func chunkedValue(b []byte) Value {
+	if len(b) <= ChunkThreshold {
+		return Value{b: b}
+	}
+	chunks := make([][]byte, 0, (len(b)+ChunkSize-1)/ChunkSize)
+	for len(b) > ChunkSize {
+		chunks = append(chunks, b[:ChunkSize:ChunkSize])
+		b = b[ChunkSize:]
+	}
+	return Value{chunks: append(chunks, b)}
+}
+
+//return value as one slice, chunks are joined into a new slice
+func (v *Value) bytes() []byte {
+	if v.chunks == nil {
+		return v.b
+	}
+	return v.ByteSlice()
+}
+
+//call f on value in pieces of at most size bytes, in order
+func (v *Value) eachChunk(size int, f func([]byte) error) error {
+	if v.chunks != nil {
+		for _, c := range v.chunks {
+			if err := f(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for b := v.b; len(b) > 0; {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		if err := f(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
 }
 
 //copy byte slice
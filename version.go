@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/cache/pb"
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//version of the entry is not the expected one, see CompareAndSet
+var ErrVersionMismatch = errors.New("dcache: version mismatch")
+
+//return a version larger than every version given out before
+func (g *GroupCache) nextVersion() uint64 {
+	return atomic.AddUint64(&g.version, 1)
+}
+
+//replace the value of key with data only if its version is still expected,
+//that is no one wrote key since the Get returning that version. 0 matches a
+//key not in cache. return the new version, or ErrVersionMismatch with the
+//current version so that the caller can Get again and retry. the write happens
+//on the owner of key, forwarded through a Peer implementing CASPeer if it is
+//not this node, so that concurrent writers on different nodes see each other.
+//replicas the owner pushed as a hot key are pushed the new value. like Add,
+//only cache is written
+func (g *GroupCache) CompareAndSet(key string, expected uint64, data []byte, ttl time.Duration) (uint64, error) {
+	if key == "" {
+		return 0, errors.New("key requied inorder to set cache")
+	}
+	if g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			return g.compareAndSetOnPeer(peer, key, expected, data, ttl)
+		}
+	}
+	return g.compareAndSetLocal(key, expected, data, ttl)
+}
+
+//CompareAndSet on this node, which owns key
+func (g *GroupCache) compareAndSetLocal(key string, expected uint64, data []byte, ttl time.Duration) (uint64, error) {
+	//an entry moved to disk still has its version
+	if _, ok := g.mainCache.peek(key); !ok {
+		g.lookupDisk(key)
+	}
+	val, err := g.store(key, Value{b: data, version: g.nextVersion()})
+	if err != nil {
+		return 0, err
+	}
+	version, ok := g.mainCache.cas(key, val, ttl, expected)
+	if !ok {
+		return version, ErrVersionMismatch
+	}
+	g.voidLease(key, Value{}, false)
+	g.dropFromDisk(key)
+	g.checkOverflow()
+	g.repush(key)
+	return version, nil
+}
+
+//forward CompareAndSet to peer owning key
+func (g *GroupCache) compareAndSetOnPeer(peer Peer, key string, expected uint64, data []byte, ttl time.Duration) (uint64, error) {
+	casPeer, ok := peer.(CASPeer)
+	if !ok {
+		return 0, fmt.Errorf("peer [%v] does not support CompareAndSet", peer.Addr())
+	}
+	req := &pb.CASRequest{
+		Group:    g.name,
+		Key:      key,
+		Expected: expected,
+		Value:    data,
+		Ttl:      ttl.Milliseconds(),
+	}
+	resp := &pb.CASResponse{}
+	if err := casPeer.CompareAndSet(req, resp); err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": g.name,
+			"key":   key,
+			"peer":  peer.Addr(),
+			"err":   err,
+		}).Errorln("compare and set on peer failed")
+		return 0, fmt.Errorf("compare and set on peer [%v] failed: %v", peer.Addr(), err)
+	}
+	//the replica here is stale now, or was already if another writer got ahead
+	g.hotCache.del(key)
+	if !resp.GetOk() {
+		return resp.GetVersion(), ErrVersionMismatch
+	}
+	return resp.GetVersion(), nil
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//persists values to the backing store, counterpart of Getter, see
+//GroupCache.Set
+type Setter interface {
+	Set(key string, val []byte) error
+}
+
+//A function type, so that Setter can be a function
+type SetterFunc func(key string, val []byte) error
+
+func (f SetterFunc) Set(key string, val []byte) error {
+	return f(key, val)
+}
+
+//deletes values from the backing store, see GroupCache.Delete
+type Deleter interface {
+	Delete(key string) error
+}
+
+//A function type, so that Deleter can be a function
+type DeleterFunc func(key string) error
+
+func (f DeleterFunc) Delete(key string) error {
+	return f(key)
+}
+
+//a write to the backing store
+type WriteOp struct {
+	Key string
+	Val []byte
+	Del bool //delete Key, Val is nil
+}
+
+//implemented by a Setter able to persist many writes at once, say in one
+//transaction. write-behind flushes batches through it instead of one Set or
+//Delete per key
+type BatchWriter interface {
+	WriteBatch(ops []WriteOp) error
+}
+
+var (
+	//Set or Delete is called without Setter or Deleter registered
+	ErrNoSetter  = errors.New("dcache: no Setter registered")
+	ErrNoDeleter = errors.New("dcache: no Deleter registered")
+
+	//key is deleted by a write-behind Delete not yet flushed
+	ErrDeleted = errors.New("dcache: key is deleted")
+)
+
+//number of write sequences a GroupCache keeps, keys share them by hash
+const writeSeqs = 64
+
+//register the Setter used by Set. writes are write-through unless
+//EnableWriteBehind is called
+func (g *GroupCache) RegisterSetter(s Setter) {
+	g.setter = s
+}
+
+//register the Deleter used by Delete
+func (g *GroupCache) RegisterDeleter(d Deleter) {
+	g.deleter = d
+}
+
+//write data to the backing store and cache. in write-through mode data is
+//persisted by Setter first and cached only if that succeeds. in write-behind
+//mode data is cached and queued at once, and persisted later, see
+//EnableWriteBehind. unlike Add, a value loaded by Getter before the write and
+//returned after it never overwrites data in cache
+func (g *GroupCache) Set(key string, data []byte, ttl time.Duration) error {
+	if g.setter == nil {
+		return ErrNoSetter
+	}
+	inc(&g.stats.writes)
+	op := WriteOp{Key: key, Val: data}
+	if err := g.persist(op); err != nil {
+		return err
+	}
+	atomic.AddUint64(g.writeSeq(key), 1)
+	g.Add(key, data, ttl)
+	return nil
+}
+
+//delete key from the backing store and cache, write-through or write-behind
+//as Set. Del only drops cache
+func (g *GroupCache) Delete(key string) error {
+	if g.deleter == nil && !g.batchWriter() {
+		return ErrNoDeleter
+	}
+	inc(&g.stats.writes)
+	if err := g.persist(WriteOp{Key: key, Del: true}); err != nil {
+		return err
+	}
+	g.Del(key)
+	return nil
+}
+
+//persist op now in write-through mode, queue it in write-behind mode
+func (g *GroupCache) persist(op WriteOp) error {
+	var err error
+	if g.writeBehind != nil {
+		err = g.writeBehind.add(op)
+	} else {
+		err = g.write([]WriteOp{op})
+	}
+	if err != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group":  g.name,
+			"key":    op.Key,
+			"delete": op.Del,
+			"err":    err,
+		}).Errorln("write backing store failed")
+	}
+	return err
+}
+
+//whether Setter persists batches
+func (g *GroupCache) batchWriter() bool {
+	_, ok := g.setter.(BatchWriter)
+	return ok
+}
+
+//write ops to the backing store, through BatchWriter if Setter implements
+//it, one by one otherwise
+func (g *GroupCache) write(ops []WriteOp) error {
+	if b, ok := g.setter.(BatchWriter); ok {
+		return b.WriteBatch(ops)
+	}
+	for _, op := range ops {
+		var err error
+		switch {
+		case !op.Del:
+			err = g.setter.Set(op.Key, op.Val)
+		case g.deleter != nil:
+			err = g.deleter.Delete(op.Key)
+		default:
+			err = ErrNoDeleter
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sequence of writes of key, shared with keys of the same hash. it is bumped
+//by every Set, Delete and Del, so that a load which saw it change while reading
+//Getter does not cache what it read
+func (g *GroupCache) writeSeq(key string) *uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &g.writeSeqs[h.Sum32()%writeSeqs]
+}
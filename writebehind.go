@@ -0,0 +1,620 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hollowdjj/course-selecting-sys/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+//config of write-behind, zero fields take defaults
+type WriteBehindOption struct {
+	//max delay of a write before it is flushed, 100ms by default
+	FlushInterval time.Duration
+
+	//max writes per batch, 100 by default
+	BatchSize int
+
+	//backoff after a failed batch, doubled on every failure up to MaxBackoff.
+	//100ms and 30s by default
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	//journal file keeping writes not yet flushed, so that they survive a
+	//restart and are flushed by the next EnableWriteBehind. empty means writes
+	//are kept in memory only. with encryption set, values are encrypted in
+	//journal as in cache, and SetEncryption must come before EnableWriteBehind
+	//to replay them
+	JournalPath string
+
+	//fsync journal on every write, so that writes survive a machine crash as
+	//well as a process crash. slower
+	SyncJournal bool
+}
+
+//default of WriteBehindOption
+const (
+	DefaultFlushInterval = 100 * time.Millisecond
+	DefaultBatchSize     = 100
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	DefaultMaxBackoff    = 30 * time.Second
+)
+
+//journal is rewritten with pending writes only once it grows beyond this
+const maxJournalBytes = 64 << 20
+
+//a queued write with its sequence number in journal
+type pendingWrite struct {
+	WriteOp
+	seq uint64
+
+	//value as written to journal if it is encrypted, see sealWrite
+	sealed []byte
+}
+
+//write-behind queue of a GroupCache. writes of the same key are coalesced, only
+//the latest one is flushed. a failed batch is put back and retried with
+//backoff, nothing is dropped
+type writeBehind struct {
+	g   *GroupCache
+	opt WriteBehindOption
+
+	mu       sync.Mutex
+	pending  map[string]*pendingWrite
+	queue    []string                 //keys of pending in order of their first write
+	inflight map[string]*pendingWrite //writes taken by a flush not yet done
+	seq      uint64
+	journal  *journal //nil if not durable
+
+	flushMu sync.Mutex //one flush at a time
+	kick    chan struct{}
+	stop    chan struct{}
+	closed  bool //guarded by mu
+	wg      sync.WaitGroup
+}
+
+//enable write-behind: Set and Delete update cache and return at once, writes
+//are flushed to Setter and Deleter in the background every FlushInterval or
+//once BatchSize writes are queued. writes of the same key are coalesced. a
+//Get loading a key with a queued write returns the queued value instead of
+//asking Getter, so reads never go back in time. with JournalPath, writes left
+//by the last run are flushed first. call it after RegisterSetter and before use
+func (g *GroupCache) EnableWriteBehind(opt WriteBehindOption) error {
+	if g.setter == nil {
+		return ErrNoSetter
+	}
+	if opt.FlushInterval <= 0 {
+		opt.FlushInterval = DefaultFlushInterval
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = DefaultBatchSize
+	}
+	if opt.RetryBackoff <= 0 {
+		opt.RetryBackoff = DefaultRetryBackoff
+	}
+	if opt.MaxBackoff < opt.RetryBackoff {
+		opt.MaxBackoff = DefaultMaxBackoff
+	}
+
+	w := &writeBehind{
+		g:       g,
+		opt:     opt,
+		pending: make(map[string]*pendingWrite),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	if opt.JournalPath != "" {
+		j, ops, seq, err := openJournal(opt.JournalPath, opt.SyncJournal)
+		if err != nil {
+			return err
+		}
+		w.journal, w.seq = j, seq
+		for _, op := range ops {
+			if err = g.openWrite(op); err != nil {
+				j.f.Close()
+				return err
+			}
+			w.enqueue(op)
+		}
+		if len(ops) > 0 {
+			logger.GetInstance().WithFields(logrus.Fields{
+				"group":  g.name,
+				"writes": len(ops),
+			}).Infoln("replay write-behind journal")
+		}
+	}
+	g.writeBehind = w
+	w.wg.Add(1)
+	go w.run()
+	return nil
+}
+
+//flush all queued writes now, return the error of the first failed batch
+func (g *GroupCache) Flush() error {
+	if g.writeBehind == nil {
+		return nil
+	}
+	return g.writeBehind.flush()
+}
+
+//return number of writes not yet flushed
+func (g *GroupCache) PendingWrites() int {
+	if g.writeBehind == nil {
+		return 0
+	}
+	w := g.writeBehind
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending) + len(w.inflight)
+}
+
+//the queued write of key, if any
+func (g *GroupCache) pendingWrite(key string) (WriteOp, bool) {
+	if g.writeBehind == nil {
+		return WriteOp{}, false
+	}
+	w := g.writeBehind
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.pending[key]; ok {
+		return p.WriteOp, true
+	}
+	if p, ok := w.inflight[key]; ok {
+		return p.WriteOp, true
+	}
+	return WriteOp{}, false
+}
+
+//journal and queue a write
+func (w *writeBehind) add(op WriteOp) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p := &pendingWrite{WriteOp: op, seq: w.seq + 1}
+	if w.journal != nil {
+		if err := w.g.sealWrite(p); err != nil {
+			return err
+		}
+		if err := w.journal.append(journalWrite, p); err != nil {
+			return err
+		}
+	}
+	w.seq++
+	w.enqueue(p)
+	if len(w.queue) >= w.opt.BatchSize {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//encrypt the value of p for journal if encryption is set. the sealed value is
+//kept with its key id as in arena, see encodeArenaValue
+func (g *GroupCache) sealWrite(p *pendingWrite) error {
+	e := g.encryptor.Load()
+	if e == nil || p.Del {
+		return nil
+	}
+	val, err := e.seal(p.Key, Value{b: p.Val})
+	if err != nil {
+		return err
+	}
+	p.sealed = encodeArenaValue(val)
+	return nil
+}
+
+//decrypt the value of p replayed from journal, if it is encrypted
+func (g *GroupCache) openWrite(p *pendingWrite) error {
+	if p.sealed == nil {
+		return nil
+	}
+	e := g.encryptor.Load()
+	if e == nil {
+		return fmt.Errorf("journal write of [%v] is encrypted but encryption is off", p.Key)
+	}
+	val, err := e.open(p.Key, decodeArenaValue(p.sealed))
+	if err != nil {
+		return fmt.Errorf("decrypt journal write of [%v] failed: %v", p.Key, err)
+	}
+	p.Val = val.bytes()
+	return nil
+}
+
+//queue p, replacing a queued write of the same key. lock must be held
+func (w *writeBehind) enqueue(p *pendingWrite) {
+	if _, ok := w.pending[p.Key]; !ok {
+		w.queue = append(w.queue, p.Key)
+	}
+	w.pending[p.Key] = p
+}
+
+//flush every FlushInterval or once a batch is full, back off after failures
+func (w *writeBehind) run() {
+	defer w.wg.Done()
+	backoff := time.Duration(0)
+	for {
+		wait := w.opt.FlushInterval
+		if backoff > 0 {
+			wait = backoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-w.kick:
+			timer.Stop()
+			if backoff > 0 {
+				continue
+			}
+		case <-w.stop:
+			timer.Stop()
+			return
+		}
+
+		if err := w.flush(); err == nil {
+			backoff = 0
+		} else if backoff == 0 {
+			backoff = w.opt.RetryBackoff
+		} else if backoff *= 2; backoff > w.opt.MaxBackoff {
+			backoff = w.opt.MaxBackoff
+		}
+	}
+}
+
+//flush batches until the queue is empty or a batch fails
+func (w *writeBehind) flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	for {
+		batch := w.take()
+		if len(batch) == 0 {
+			return nil
+		}
+		ops := make([]WriteOp, len(batch))
+		for i, p := range batch {
+			ops[i] = p.WriteOp
+		}
+		err := w.g.write(ops)
+		w.done(batch, err)
+		if err != nil {
+			inc(&w.g.stats.writeErrors)
+			logger.GetInstance().WithFields(logrus.Fields{
+				"group":  w.g.name,
+				"writes": len(batch),
+				"err":    err,
+			}).Errorln("flush write-behind batch failed")
+			return err
+		}
+	}
+}
+
+//take at most BatchSize writes from the head of queue
+func (w *writeBehind) take() []*pendingWrite {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(w.queue)
+	if n > w.opt.BatchSize {
+		n = w.opt.BatchSize
+	}
+	batch := make([]*pendingWrite, n)
+	w.inflight = make(map[string]*pendingWrite, n)
+	for i, key := range w.queue[:n] {
+		batch[i] = w.pending[key]
+		w.inflight[key] = batch[i]
+		delete(w.pending, key)
+	}
+	w.queue = append(w.queue[:0], w.queue[n:]...)
+	return batch
+}
+
+//finish a batch. a failed batch is put back in front of the queue, except
+//writes whose keys are written again meanwhile. a flushed batch is acked in
+//journal
+func (w *writeBehind) done(batch []*pendingWrite, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inflight = nil
+	if err != nil {
+		var back []string
+		for _, p := range batch {
+			if _, ok := w.pending[p.Key]; !ok {
+				w.pending[p.Key] = p
+				back = append(back, p.Key)
+			}
+		}
+		w.queue = append(back, w.queue...)
+		return
+	}
+
+	atomic.AddInt64(&w.g.stats.writesFlushed, int64(len(batch)))
+	if w.journal == nil {
+		return
+	}
+	var jerr error
+	switch {
+	case len(w.pending) == 0:
+		jerr = w.journal.truncate()
+	case w.journal.size > maxJournalBytes:
+		jerr = w.journal.rewrite(w.pending)
+	default:
+		for _, p := range batch {
+			if jerr = w.journal.append(journalAck, p); jerr != nil {
+				break
+			}
+		}
+	}
+	if jerr != nil {
+		logger.GetInstance().WithFields(logrus.Fields{
+			"group": w.g.name,
+			"err":   jerr,
+		}).Errorln("update write-behind journal failed")
+	}
+}
+
+//stop flushing in background, flush what is left once and close journal.
+//writes failing the last flush stay in journal. nothing happens if already
+//closed
+func (w *writeBehind) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.stop)
+	w.mu.Unlock()
+	w.wg.Wait()
+	w.flush()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.journal != nil {
+		w.journal.f.Close()
+	}
+}
+
+//kinds of journal records
+const (
+	journalWrite = 1 //a queued write
+	journalAck   = 2 //the write of key with seq is flushed
+
+	//del of a write whose value is encrypted
+	journalSealed = 2
+)
+
+//append-only file of queued writes and acks. a record is
+//	kind uint8 | seq uvarint | del uint8 | len(key) uvarint | key |
+//	len(val) uvarint | val | crc32c of the record uint32
+//an ack carries no value. del is journalSealed for an encrypted value. a torn
+//record at the tail is ignored on replay
+type journal struct {
+	f    *os.File
+	path string
+	sync bool
+	size int64
+	buf  []byte
+}
+
+//open journal at path, return writes not yet acked and the largest seq in it
+func openJournal(path string, sync bool) (*journal, []*pendingWrite, uint64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	ops, size, seq, err := replayJournal(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	//drop a torn tail, so that new records follow the last complete one
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+	return &journal{f: f, path: path, sync: sync, size: size}, ops, seq, nil
+}
+
+//read records of journal, return writes not yet acked in order of seq, bytes
+//of complete records and the largest seq. seq keeps growing after a restart,
+//so that an old ack never matches a new write
+func replayJournal(f *os.File) ([]*pendingWrite, int64, uint64, error) {
+	r := bufio.NewReader(f)
+	latest := make(map[string]*pendingWrite)
+	var size int64
+	var seq uint64
+	for {
+		kind, p, n, err := readJournalRecord(r)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrChecksum) {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		size += n
+		if p.seq > seq {
+			seq = p.seq
+		}
+		switch cur := latest[p.Key]; {
+		case kind == journalWrite && (cur == nil || p.seq > cur.seq):
+			latest[p.Key] = p
+		case kind == journalAck && cur != nil && p.seq >= cur.seq:
+			delete(latest, p.Key)
+		}
+	}
+	ops := make([]*pendingWrite, 0, len(latest))
+	for _, p := range latest {
+		ops = append(ops, p)
+	}
+	sortBySeq(ops)
+	return ops, size, seq, nil
+}
+
+//sort writes by seq, that is in order they are written
+func sortBySeq(ops []*pendingWrite) {
+	sort.Slice(ops, func(i, j int) bool { return ops[i].seq < ops[j].seq })
+}
+
+//counts bytes read through it, and crc32c of them
+type countingReader struct {
+	r   *bufio.Reader
+	n   int64
+	crc uint32
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+		c.crc = crc32.Update(c.crc, crcTable, []byte{b})
+	}
+	return b, err
+}
+
+func (c *countingReader) readFull(b []byte) error {
+	n, err := io.ReadFull(c.r, b)
+	c.n += int64(n)
+	c.crc = crc32.Update(c.crc, crcTable, b[:n])
+	return err
+}
+
+//read one record, return its kind, write and size
+func readJournalRecord(br *bufio.Reader) (byte, *pendingWrite, int64, error) {
+	r := &countingReader{r: br}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	p := &pendingWrite{}
+	if p.seq, err = binary.ReadUvarint(r); err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	del, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	p.Del = del == 1
+	fields := [2][]byte{}
+	for i := range fields {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > maxSnapshotField {
+			return 0, nil, 0, io.ErrUnexpectedEOF
+		}
+		fields[i] = make([]byte, n)
+		if err = r.readFull(fields[i]); err != nil {
+			return 0, nil, 0, io.ErrUnexpectedEOF
+		}
+	}
+	p.Key = string(fields[0])
+	switch {
+	case kind == journalWrite && del == journalSealed:
+		p.sealed = fields[1]
+	case kind == journalWrite && !p.Del:
+		p.Val = fields[1]
+	}
+	want := r.crc
+	var sum [4]byte
+	if _, err = io.ReadFull(br, sum[:]); err != nil {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(sum[:]) != want {
+		return 0, nil, 0, ErrChecksum
+	}
+	return kind, p, r.n + 4, nil
+}
+
+//append a record of p
+func (j *journal) append(kind byte, p *pendingWrite) error {
+	b := appendJournalRecord(j.buf[:0], kind, p)
+	j.buf = b
+	if _, err := j.f.WriteAt(b, j.size); err != nil {
+		return err
+	}
+	j.size += int64(len(b))
+	if j.sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+//encode a record of p onto b
+func appendJournalRecord(b []byte, kind byte, p *pendingWrite) []byte {
+	start := len(b)
+	b = append(b, kind)
+	b = binary.AppendUvarint(b, p.seq)
+	val := p.Val
+	switch {
+	case p.Del:
+		b = append(b, 1)
+	case p.sealed != nil:
+		b = append(b, journalSealed)
+		val = p.sealed
+	default:
+		b = append(b, 0)
+	}
+	b = binary.AppendUvarint(b, uint64(len(p.Key)))
+	b = append(b, p.Key...)
+	if kind == journalWrite {
+		b = binary.AppendUvarint(b, uint64(len(val)))
+		b = append(b, val...)
+	} else {
+		b = binary.AppendUvarint(b, 0)
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b[start:], crcTable))
+}
+
+//drop all records, every write is flushed
+func (j *journal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	if j.sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+//replace journal with records of pending writes only. the new journal is
+//written aside and renamed, so a crash leaves either one complete
+func (j *journal) rewrite(pending map[string]*pendingWrite) error {
+	ops := make([]*pendingWrite, 0, len(pending))
+	for _, p := range pending {
+		ops = append(ops, p)
+	}
+	sortBySeq(ops)
+	var b []byte
+	for _, p := range ops {
+		b = appendJournalRecord(b, journalWrite, p)
+	}
+
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0o644)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+	j.f.Close()
+	j.f = f
+	j.size = int64(len(b))
+	return nil
+}